@@ -19,12 +19,30 @@ go_root = "/usr/local/go"
 # go_path = "/home/dawndiy/workspace/golang"
 go_path = "{}/gopkg".format(os.getcwd())
 go_packages = [
+    "github.com/oschwald/maxminddb-golang",
+    "github.com/quic-go/quic-go",
     "github.com/shadowsocks/shadowsocks-go/shadowsocks",
     "github.com/skip2/go-qrcode",
+    "github.com/xtaci/kcp-go/v5",
     "golang.org/x/crypto/blowfish",
     "golang.org/x/crypto/cast5",
+    "golang.org/x/crypto/chacha20poly1305",
+    "golang.org/x/crypto/hkdf",
     "golang.org/x/crypto/salsa20/salsa",
+    "golang.org/x/net/dns/dnsmessage",
     "gopkg.in/qml.v1",
+    "gvisor.dev/gvisor/pkg/tcpip",
+    "gvisor.dev/gvisor/pkg/tcpip/adapters/gonet",
+    "gvisor.dev/gvisor/pkg/tcpip/header",
+    "gvisor.dev/gvisor/pkg/tcpip/link/fdbased",
+    "gvisor.dev/gvisor/pkg/tcpip/link/tun",
+    "gvisor.dev/gvisor/pkg/tcpip/network/ipv4",
+    "gvisor.dev/gvisor/pkg/tcpip/network/ipv6",
+    "gvisor.dev/gvisor/pkg/tcpip/stack",
+    "gvisor.dev/gvisor/pkg/tcpip/transport/tcp",
+    "gvisor.dev/gvisor/pkg/tcpip/transport/udp",
+    "gvisor.dev/gvisor/pkg/waiter",
+    "lukechampine.com/blake3",
 ]
 
 
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ACL is a rule set in the acl format of shadowsocks-libev. Sections list
+// the destinations of a route, one domain or CIDR per line:
+//
+//	[bypass_all]      route everything directly by default
+//	[proxy_all]       route everything through the servers by default
+//	[bypass_list]     destinations routed directly
+//	[proxy_list]      destinations routed through the servers
+//	[reject_list]     destinations refused
+//
+// A domain matches itself and its subdomains, the libev form
+// "(^|\.)example\.com$" is accepted too. Lines starting with # are comments.
+type ACL struct {
+	mu         sync.RWMutex
+	hasDefault bool
+	defaultTo  Route
+	lists      map[Route]*ruleList
+}
+
+// ruleList is the destinations of one route
+type ruleList struct {
+	domains map[string]bool
+	nets    []*net.IPNet
+}
+
+func newRuleList() *ruleList {
+	return &ruleList{domains: make(map[string]bool)}
+}
+
+// add a domain, an IP or a CIDR
+func (l *ruleList) add(rule string) error {
+	if strings.Contains(rule, "/") {
+		_, ipnet, err := net.ParseCIDR(rule)
+		if err != nil {
+			return err
+		}
+		l.nets = append(l.nets, ipnet)
+		return nil
+	}
+	if ip := net.ParseIP(rule); ip != nil {
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		l.nets = append(l.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		return nil
+	}
+	rule = strings.TrimPrefix(rule, `(^|\.)`)
+	rule = strings.TrimSuffix(rule, "$")
+	rule = strings.Replace(rule, `\.`, ".", -1)
+	l.domains[strings.ToLower(strings.TrimPrefix(rule, "."))] = true
+	return nil
+}
+
+// match report whether host, a domain or an IP, is in the list
+func (l *ruleList) match(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipnet := range l.nets {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for {
+		if l.domains[host] {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
+
+// LoadACL read an acl file, a gfwlist if its name ends with .txt
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	parse := ParseACL
+	if strings.HasSuffix(path, ".txt") {
+		parse = ParseGFWList
+	}
+	acl, err := parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return acl, nil
+}
+
+// ParseACL read an acl from r
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := &ACL{lists: make(map[Route]*ruleList)}
+	var list *ruleList
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		switch line {
+		case "[bypass_all]":
+			acl.hasDefault, acl.defaultTo = true, RouteDirect
+		case "[proxy_all]", "[accept_all]":
+			acl.hasDefault, acl.defaultTo = true, RouteProxy
+		case "[bypass_list]", "[white_list]":
+			list = acl.list(RouteDirect)
+		case "[proxy_list]", "[black_list]":
+			list = acl.list(RouteProxy)
+		case "[reject_list]", "[outbound_block_list]":
+			list = acl.list(RouteReject)
+		default:
+			if list == nil {
+				return nil, fmt.Errorf("line %d: rule outside of a list", n)
+			}
+			if err := list.add(line); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// replace the rules of a with the ones of b, while a may be in use
+func (a *ACL) replace(b *ACL) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.hasDefault, a.defaultTo, a.lists = b.hasDefault, b.defaultTo, b.lists
+}
+
+func (a *ACL) list(route Route) *ruleList {
+	list, ok := a.lists[route]
+	if !ok {
+		list = newRuleList()
+		a.lists[route] = list
+	}
+	return list
+}
+
+// Route return the route of the first list matching host, rejections first,
+// or the default of the acl
+func (a *ACL) Route(host string, port int) (Route, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, route := range []Route{RouteReject, RouteDirect, RouteProxy} {
+		if list, ok := a.lists[route]; ok && list.match(host) {
+			return route, true
+		}
+	}
+	return a.defaultTo, a.hasDefault
+}
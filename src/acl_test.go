@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseACL(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(`
+# comment
+[proxy_all]
+
+[bypass_list]
+(^|\.)cn$
+192.168.0.0/16
+10.0.0.1
+
+[reject_list]
+ads.example.com
+
+[proxy_list]
+example.com
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host  string
+		route Route
+	}{
+		{"www.baidu.cn", RouteDirect},
+		{"192.168.1.1", RouteDirect},
+		{"10.0.0.1", RouteDirect},
+		{"10.0.0.2", RouteProxy},
+		{"ads.example.com", RouteReject},
+		{"www.example.com", RouteProxy},
+		{"other.test", RouteProxy},
+	}
+	for _, tt := range tests {
+		if route, ok := acl.Route(tt.host, 443); !ok || route != tt.route {
+			t.Errorf("%s: route %v, %v, want %v", tt.host, route, ok, tt.route)
+		}
+	}
+
+	if _, err := ParseACL(strings.NewReader("example.com\n")); err == nil {
+		t.Error("rule outside of a list accepted")
+	}
+	if _, err := ParseACL(strings.NewReader("[bypass_list]\n10.0.0.0/33\n")); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import "sync"
+
+// adaptiveBufSizes are the size classes of adaptive buffers
+var adaptiveBufSizes = []int{512, 2048, 8192, 32768}
+
+var adaptiveBufPools = func() []*sync.Pool {
+	pools := make([]*sync.Pool, len(adaptiveBufSizes))
+	for i, size := range adaptiveBufSizes {
+		size := size
+		pools[i] = &sync.Pool{New: func() interface{} { return make([]byte, size) }}
+	}
+	return pools
+}()
+
+// adaptiveBuf is the read buffer of a pipe. It starts small, moves up a size
+// class every time a read fills it and falls back to the smallest when the
+// pipe is idle, so mostly idle tunnels hold little memory.
+type adaptiveBuf struct {
+	class int
+	buf   []byte
+}
+
+func newAdaptiveBuf() *adaptiveBuf {
+	return &adaptiveBuf{buf: adaptiveBufPools[0].Get().([]byte)}
+}
+
+func (b *adaptiveBuf) resize(class int) {
+	if class == b.class {
+		return
+	}
+	adaptiveBufPools[b.class].Put(b.buf)
+	b.class = class
+	b.buf = adaptiveBufPools[class].Get().([]byte)
+}
+
+// grow move to the next size class if any
+func (b *adaptiveBuf) grow() {
+	if b.class+1 < len(adaptiveBufSizes) {
+		b.resize(b.class + 1)
+	}
+}
+
+// shrink move back to the smallest size class
+func (b *adaptiveBuf) shrink() {
+	b.resize(0)
+}
+
+// release return the buffer to its pool, b can't be used afterwards
+func (b *adaptiveBuf) release() {
+	adaptiveBufPools[b.class].Put(b.buf)
+	b.buf = nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// aeadMaxPayload is the largest chunk of a tcp stream, the two high
+	// bits of the length are reserved
+	aeadMaxPayload = 0x3fff
+	aeadTagSize    = 16
+)
+
+var errAEADShortPacket = errors.New("aead packet too short")
+
+// aeadCipher is an AEAD cipher of the shadowsocks protocol, see SIP004.
+// Every connection and packet starts with a random salt, the subkey
+// derived from it and the master key seals the data.
+type aeadCipher struct {
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+// newAEADCipher return the AEAD cipher of method keyed with password, or nil
+// if method is not an AEAD method
+func newAEADCipher(method, password string) *aeadCipher {
+	var keySize int
+	var newAEAD func(key []byte) (cipher.AEAD, error)
+	switch method {
+	case "aes-128-gcm", "aes-192-gcm", "aes-256-gcm":
+		keySize = map[string]int{"aes-128-gcm": 16, "aes-192-gcm": 24, "aes-256-gcm": 32}[method]
+		newAEAD = func(key []byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		}
+	case "chacha20-ietf-poly1305":
+		keySize, newAEAD = chacha20poly1305.KeySize, chacha20poly1305.New
+	case "xchacha20-ietf-poly1305":
+		keySize, newAEAD = chacha20poly1305.KeySize, chacha20poly1305.NewX
+	default:
+		return nil
+	}
+	return &aeadCipher{key: evpBytesToKey(password, keySize), newAEAD: newAEAD}
+}
+
+// evpBytesToKey derive a key from password like OpenSSL's EVP_BytesToKey
+// with md5, as every shadowsocks implementation does
+func evpBytesToKey(password string, keySize int) []byte {
+	var key, prev []byte
+	h := md5.New()
+	for len(key) < keySize {
+		h.Reset()
+		h.Write(prev)
+		h.Write([]byte(password))
+		key = h.Sum(key)
+		prev = key[len(key)-md5.Size:]
+	}
+	return key[:keySize]
+}
+
+// saltSize is the size of the salt, the same as the key
+func (c *aeadCipher) saltSize() int {
+	return len(c.key)
+}
+
+// aead return the cipher sealing data after salt
+func (c *aeadCipher) aead(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	r := hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey"))
+	if _, err := io.ReadFull(r, subkey); err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
+
+func (c *aeadCipher) StreamConn(conn net.Conn) net.Conn {
+	return &aeadConn{Conn: conn, cipher: c}
+}
+
+func (c *aeadCipher) PacketConn(pc net.PacketConn) net.PacketConn {
+	return &aeadPacketConn{PacketConn: pc, cipher: c}
+}
+
+// aeadConn encrypt a tcp stream as chunks of sealed length and payload
+type aeadConn struct {
+	net.Conn
+	cipher *aeadCipher
+
+	enc      cipher.AEAD
+	encNonce []byte
+	encBuf   []byte
+
+	dec      cipher.AEAD
+	decNonce []byte
+	decBuf   []byte
+	leftover []byte
+
+	// reads failing in the middle of the salt or a chunk, e.g. on a read
+	// deadline, leave what they read for the next read to resume
+	salt     []byte
+	partial  int
+	size     int
+	haveSize bool
+}
+
+func (c *aeadConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var out []byte
+	if c.enc == nil {
+		salt := make([]byte, c.cipher.saltSize())
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		enc, err := c.cipher.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.enc, c.encNonce = enc, make([]byte, enc.NonceSize())
+		c.encBuf = make([]byte, 0, 2+aeadTagSize+aeadMaxPayload+aeadTagSize)
+		out = salt
+	}
+
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > aeadMaxPayload {
+			n = aeadMaxPayload
+		}
+		buf := append(c.encBuf[:0], out...)
+		var size [2]byte
+		binary.BigEndian.PutUint16(size[:], uint16(n))
+		buf = c.enc.Seal(buf, c.encNonce, size[:], nil)
+		increment(c.encNonce)
+		buf = c.enc.Seal(buf, c.encNonce, b[:n], nil)
+		increment(c.encNonce)
+		if _, err := c.Conn.Write(buf); err != nil {
+			return written, err
+		}
+		out = nil
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *aeadConn) Read(b []byte) (int, error) {
+	if len(c.leftover) > 0 {
+		n := copy(b, c.leftover)
+		c.leftover = c.leftover[n:]
+		return n, nil
+	}
+	if c.dec == nil {
+		if c.salt == nil {
+			c.salt = make([]byte, c.cipher.saltSize())
+		}
+		if err := c.readFull(c.salt); err != nil {
+			return 0, err
+		}
+		dec, err := c.cipher.aead(c.salt)
+		if err != nil {
+			return 0, err
+		}
+		c.dec, c.decNonce = dec, make([]byte, dec.NonceSize())
+		c.decBuf = make([]byte, aeadMaxPayload+aeadTagSize)
+	}
+
+	if !c.haveSize {
+		buf := c.decBuf[:2+aeadTagSize]
+		if err := c.readFull(buf); err != nil {
+			return 0, err
+		}
+		size, err := c.dec.Open(buf[:0], c.decNonce, buf, nil)
+		if err != nil {
+			return 0, err
+		}
+		increment(c.decNonce)
+		c.size = int(binary.BigEndian.Uint16(size)) & aeadMaxPayload
+		c.haveSize = true
+	}
+
+	buf := c.decBuf[:c.size+aeadTagSize]
+	if err := c.readFull(buf); err != nil {
+		return 0, err
+	}
+	c.haveSize = false
+	payload, err := c.dec.Open(buf[:0], c.decNonce, buf, nil)
+	if err != nil {
+		return 0, err
+	}
+	increment(c.decNonce)
+	copied := copy(b, payload)
+	c.leftover = payload[copied:]
+	return copied, nil
+}
+
+// readFull fill buf from the connection, resuming after the bytes read into
+// it by a previous call which failed
+func (c *aeadConn) readFull(buf []byte) error {
+	n, err := io.ReadFull(c.Conn, buf[c.partial:])
+	c.partial += n
+	if err != nil {
+		return err
+	}
+	c.partial = 0
+	return nil
+}
+
+// aeadPacketConn seal every packet with its own salt and a zero nonce
+type aeadPacketConn struct {
+	net.PacketConn
+	cipher *aeadCipher
+	mu     sync.Mutex
+	buf    []byte
+}
+
+func (c *aeadPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	salt := make([]byte, c.cipher.saltSize())
+	if _, err := rand.Read(salt); err != nil {
+		return 0, err
+	}
+	aead, err := c.cipher.aead(salt)
+	if err != nil {
+		return 0, err
+	}
+	c.buf = append(c.buf[:0], salt...)
+	c.buf = aead.Seal(c.buf, make([]byte, aead.NonceSize()), b, nil)
+	if _, err := c.PacketConn.WriteTo(c.buf, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *aeadPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+	saltSize := c.cipher.saltSize()
+	if n < saltSize+aeadTagSize {
+		return 0, addr, errAEADShortPacket
+	}
+	aead, err := c.cipher.aead(b[:saltSize])
+	if err != nil {
+		return 0, addr, err
+	}
+	sealed := b[saltSize:n]
+	payload, err := aead.Open(sealed[:0], make([]byte, aead.NonceSize()), sealed, nil)
+	if err != nil {
+		return 0, addr, err
+	}
+	return copy(b, payload), addr, nil
+}
+
+// increment the little endian nonce
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
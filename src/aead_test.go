@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// aeadStream seal payload as one chunk after salt with key, like a SIP004
+// encoder written from the spec
+func aeadStream(t *testing.T, subkey, salt, payload []byte) []byte {
+	block, err := aes.NewCipher(subkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(payload)))
+	stream := append([]byte(nil), salt...)
+	stream = aead.Seal(stream, nonce, size[:], nil)
+	nonce[0]++
+	return aead.Seal(stream, nonce, payload, nil)
+}
+
+func TestAEADKnownAnswer(t *testing.T) {
+	// keys of the password "barfoo!" and the salt 0, 1, ... 31 computed with
+	// EVP_BytesToKey and HKDF-SHA1 by an independent implementation
+	tests := []struct {
+		method, key, subkey string
+	}{
+		{"aes-128-gcm", "b3adc47839e047eb228870526dc8fc30", "9cd21fb890a57fbe98653cbadd4d047c"},
+		{"aes-256-gcm", "b3adc47839e047eb228870526dc8fc30b347287ffca3045dcea06b3fdf090acb",
+			"6e62f41174d7879ffea269ebf7805b730f62002e2b461f4dcb2a21dfb6f6423e"},
+	}
+	for _, test := range tests {
+		c := newAEADCipher(test.method, "barfoo!")
+		if key := hex.EncodeToString(c.key); key != test.key {
+			t.Errorf("%s: key %s, want %s", test.method, key, test.key)
+			continue
+		}
+		salt := make([]byte, c.saltSize())
+		for i := range salt {
+			salt[i] = byte(i)
+		}
+		subkey, _ := hex.DecodeString(test.subkey)
+		a, b := net.Pipe()
+		go func() {
+			b.Write(aeadStream(t, subkey, salt, []byte("known answer")))
+			b.Close()
+		}()
+		plain, err := io.ReadAll(c.StreamConn(a))
+		if err != nil || string(plain) != "known answer" {
+			t.Errorf("%s: decrypted %q, %v", test.method, plain, err)
+		}
+	}
+}
+
+func TestAEADRoundTrip(t *testing.T) {
+	msg := bytes.Repeat([]byte("0123456789abcdef"), 3*aeadMaxPayload/16)
+	for _, method := range []string{"aes-128-gcm", "aes-256-gcm", "chacha20-ietf-poly1305", "xchacha20-ietf-poly1305"} {
+		c := newAEADCipher(method, "secret")
+		a, b := net.Pipe()
+		go func() {
+			c.StreamConn(b).Write(msg)
+			b.Close()
+		}()
+		plain, err := io.ReadAll(c.StreamConn(a))
+		if err != nil || !bytes.Equal(plain, msg) {
+			t.Errorf("%s: got %d bytes, %v, want %d", method, len(plain), err, len(msg))
+		}
+	}
+}
+
+func TestAEADReadResumesAfterTimeout(t *testing.T) {
+	c := newAEADCipher("aes-256-gcm", "secret")
+	var stream bytes.Buffer
+	c.StreamConn(&bufferConn{Buffer: &stream}).Write([]byte("first chunk"))
+	data := stream.Bytes()
+
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := c.StreamConn(a)
+	// cut the stream in the salt, the length and the payload
+	cuts := [][]byte{data[:10], data[10:40], data[40:55], data[55:]}
+	for i, cut := range cuts {
+		go b.Write(cut)
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if i < len(cuts)-1 {
+			if !isTimeout(err) {
+				t.Fatalf("read %q, %v, want a timeout", buf[:n], err)
+			}
+		} else if err != nil || string(buf[:n]) != "first chunk" {
+			t.Fatalf("read %q, %v after timeouts", buf[:n], err)
+		}
+	}
+}
+
+// bufferConn is a connection writing to a buffer
+type bufferConn struct {
+	net.Conn
+	*bytes.Buffer
+}
+
+func (c *bufferConn) Read(b []byte) (int, error)  { return c.Buffer.Read(b) }
+func (c *bufferConn) Write(b []byte) (int, error) { return c.Buffer.Write(b) }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// SetAllowedClients set the networks, in CIDR notation or single addresses,
+// the clients must connect from. Other connections are closed as soon as
+// they are accepted, before the handshake. No network allows every client,
+// which is only safe on a listener bound to the loopback.
+func (s *Service) SetAllowedClients(networks ...string) error {
+	allowed, err := parseClientNetworks(networks)
+	if err != nil {
+		return err
+	}
+	s.allowedClients = allowed
+	return nil
+}
+
+// parseClientNetworks parse the networks of SetAllowedClients
+func parseClientNetworks(networks []string) ([]*net.IPNet, error) {
+	allowed := make([]*net.IPNet, 0, len(networks))
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid client address %q", network)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			allowed = append(allowed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		allowed = append(allowed, ipnet)
+	}
+	return allowed, nil
+}
+
+// clientAllowed report whether a client connecting from addr is in the
+// allowed networks
+func (s *Service) clientAllowed(addr net.Addr) bool {
+	if len(s.allowedClients) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP(addr))
+	for _, ipnet := range s.allowedClients {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"hash/fnv"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PickRequest describe the connection a server is picked for
+type PickRequest struct {
+	Client      string // address of the socks client
+	Destination string // host:port requested by the client
+	UDP         bool   // the request relays udp packets
+}
+
+// LoadBalancer choose the server of a new connection. Pick is called with
+// the healthy servers only, or all of them when none is healthy, and must be
+// safe for concurrent use.
+type LoadBalancer interface {
+	Pick(servers []*ServerCipher, req PickRequest) *ServerCipher
+}
+
+// SetLoadBalancer set the balancer used to pick servers, nil means always
+// the first healthy server
+func (s *Service) SetLoadBalancer(balancer LoadBalancer) {
+	s.balancer = balancer
+}
+
+// pickServer return the server for a new connection, nil for udp requests
+// when no server relays udp packets
+func (s *Service) pickServer(req PickRequest) *ServerCipher {
+	servers := s.healthyServers(req.UDP)
+	if len(servers) == 0 {
+		return nil
+	}
+	if s.balancer == nil || len(servers) == 1 {
+		return servers[0]
+	}
+	if server := s.balancer.Pick(servers, req); server != nil {
+		return server
+	}
+	return servers[0]
+}
+
+// healthyServers return the configured servers which are not known to be
+// down, or all of them if every server is down. For udp only the servers
+// relaying udp packets are returned.
+func (s *Service) healthyServers(udp bool) []*ServerCipher {
+	s.serversMu.RLock()
+	servers := s.servers
+	s.serversMu.RUnlock()
+	if udp {
+		servers = udpServers(servers)
+	}
+
+	healthy := make([]*ServerCipher, 0, len(servers))
+	for _, server := range servers {
+		if !s.isDown(server.server) {
+			healthy = append(healthy, server)
+		}
+	}
+	if len(healthy) == 0 {
+		return servers
+	}
+	return healthy
+}
+
+// roundRobinBalancer take the healthy servers in turn
+type roundRobinBalancer struct {
+	next uint32
+}
+
+// NewRoundRobinBalancer return a balancer rotating connections among the
+// healthy servers, use ReloadServers to configure several of them
+func NewRoundRobinBalancer() LoadBalancer {
+	return &roundRobinBalancer{}
+}
+
+func (b *roundRobinBalancer) Pick(servers []*ServerCipher, req PickRequest) *ServerCipher {
+	n := atomic.AddUint32(&b.next, 1) - 1
+	return servers[n%uint32(len(servers))]
+}
+
+// latencyBalancer pick the server with the lowest measured latency
+type latencyBalancer struct {
+	s *Service
+}
+
+// LatencyBalancer return a balancer sending connections to the healthy
+// server of s with the lowest latency, as measured by the last dial or
+// probe. The latencies are divided by the weights of the servers, so a
+// server of weight 2 is preferred until it is twice as slow as one of weight
+// 1. Servers never measured are only picked when none was. Use
+// SetHealthCheckInterval to keep latencies up to date.
+func (s *Service) LatencyBalancer() LoadBalancer {
+	return &latencyBalancer{s}
+}
+
+func (b *latencyBalancer) Pick(servers []*ServerCipher, req PickRequest) *ServerCipher {
+	var best *ServerCipher
+	var bestLatency time.Duration
+	for _, server := range servers {
+		latency, ok := b.s.serverLatency(server.server)
+		latency /= time.Duration(server.Weight())
+		if ok && (best == nil || latency < bestLatency) {
+			best, bestLatency = server, latency
+		}
+	}
+	return best
+}
+
+// udpServers return the servers of servers relaying udp packets
+func udpServers(servers []*ServerCipher) []*ServerCipher {
+	list := make([]*ServerCipher, 0, len(servers))
+	for _, server := range servers {
+		if !server.tcpOnly {
+			list = append(list, server)
+		}
+	}
+	return list
+}
+
+// untriedServer report whether a healthy server is not in tried
+func (s *Service) untriedServer(tried map[*ServerCipher]bool) bool {
+	for _, server := range s.healthyServers(false) {
+		if !tried[server] {
+			return true
+		}
+	}
+	return false
+}
+
+// weightedBalancer is a smooth weighted round robin, as in nginx
+type weightedBalancer struct {
+	mu      sync.Mutex
+	current map[*ServerCipher]int
+}
+
+// NewWeightedBalancer return a balancer spreading connections among the
+// healthy servers in proportion to their weight. A server which goes down
+// gives its share to the others until it is back. Latencies are ignored,
+// the latency balancer uses the weights too, see LatencyBalancer.
+func NewWeightedBalancer() LoadBalancer {
+	return &weightedBalancer{current: make(map[*ServerCipher]int)}
+}
+
+func (b *weightedBalancer) Pick(servers []*ServerCipher, req PickRequest) *ServerCipher {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best *ServerCipher
+	total := 0
+	for _, server := range servers {
+		weight := server.Weight()
+		total += weight
+		b.current[server] += weight
+		if best == nil || b.current[server] > b.current[best] {
+			best = server
+		}
+	}
+	b.current[best] -= total
+
+	// forget servers removed by a reload
+	if len(b.current) > len(servers) {
+		alive := make(map[*ServerCipher]int, len(servers))
+		for _, server := range servers {
+			alive[server] = b.current[server]
+		}
+		b.current = alive
+	}
+	return best
+}
+
+// AffinityKey is what a session affinity balancer hashes
+type AffinityKey int
+
+// Keys of session affinity
+const (
+	AffinityClientIP AffinityKey = iota
+	AffinityDestination
+)
+
+// affinityBalancer use rendezvous hashing, the server with the highest hash
+// of key and server address wins. When it is down the key moves to the next
+// highest, and keys of the other servers don't move.
+type affinityBalancer struct {
+	key AffinityKey
+}
+
+// NewSessionAffinityBalancer return a balancer sending all connections from
+// the same client ip, or to the same destination host, through the same
+// server as long as it is healthy
+func NewSessionAffinityBalancer(key AffinityKey) LoadBalancer {
+	return &affinityBalancer{key}
+}
+
+func (b *affinityBalancer) Pick(servers []*ServerCipher, req PickRequest) *ServerCipher {
+	key := req.Client
+	if b.key == AffinityDestination {
+		key = req.Destination
+	}
+	if host, _, err := net.SplitHostPort(key); err == nil {
+		key = host
+	}
+
+	var best *ServerCipher
+	var bestHash uint64
+	for _, server := range servers {
+		h := fnv.New64a()
+		io.WriteString(h, key)
+		h.Write([]byte{0})
+		io.WriteString(h, server.server)
+		if sum := h.Sum64(); best == nil || sum > bestHash {
+			best, bestHash = server, sum
+		}
+	}
+	return best
+}
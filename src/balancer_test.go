@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyBalancerWeights(t *testing.T) {
+	fast := &ServerCipher{server: "fast.test:8388"}
+	heavy := &ServerCipher{server: "heavy.test:8388"}
+	heavy.SetWeight(2)
+	s := NewService(fast)
+	s.recordHealth(fast.server, 100*time.Millisecond, nil)
+	s.recordHealth(heavy.server, 150*time.Millisecond, nil)
+
+	b := s.LatencyBalancer()
+	if got := b.Pick([]*ServerCipher{fast, heavy}, PickRequest{}); got != heavy {
+		t.Fatalf("picked %s, want the server of weight 2 under twice the latency", got.server)
+	}
+	s.recordHealth(heavy.server, 250*time.Millisecond, nil)
+	if got := b.Pick([]*ServerCipher{fast, heavy}, PickRequest{}); got != fast {
+		t.Fatalf("picked %s, want the server over twice as fast", got.server)
+	}
+}
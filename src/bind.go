@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// bindAcceptTimeout is how long a BIND waits for the inbound connection
+const bindAcceptTimeout = 2 * time.Minute
+
+// handleBind serve the BIND command. The shadowsocks protocol has no way to
+// listen on the server, so the socket is bound locally on the address the
+// client connected to, and the inbound connection is relayed directly. Peers
+// at blocked addresses are refused.
+func (s *Service) handleBind(conn net.Conn, addr string) {
+	if s.route(addr) == RouteReject {
+		s.debug.Println("blocked", addr)
+		conn.Write(socksReply(repNotAllowed, unspecifiedAddr(conn)))
+		return
+	}
+	localAddr, _ := conn.LocalAddr().(*net.TCPAddr)
+	laddr := &net.TCPAddr{}
+	if localAddr != nil {
+		laddr.IP = localAddr.IP
+	}
+	listener, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		s.debug.Println("bind:", err)
+		conn.Write(socksReply(repGeneralFailure, unspecifiedAddr(conn)))
+		return
+	}
+	if !s.trackListener(listener, false) {
+		listener.Close()
+		return
+	}
+	defer s.untrackListener(listener)
+	defer listener.Close()
+
+	// first reply, the address the peer should connect to
+	if _, err := conn.Write(socksReply(repSucceeded, listener.Addr())); err != nil {
+		s.debug.Println("bind:", err)
+		return
+	}
+	s.debug.Printf("bind for %s on %s\n", addr, listener.Addr())
+	if s.accessLog {
+		s.logger.Printf("bind for %s on %s", addr, listener.Addr())
+	}
+
+	listener.SetDeadline(s.now().Add(bindAcceptTimeout))
+	peer, err := listener.AcceptTCP()
+	if err != nil {
+		s.debug.Println("bind:", err)
+		conn.Write(socksReply(repTTLExpired, unspecifiedAddr(conn)))
+		return
+	}
+	listener.Close()
+
+	// second reply, the address of the connected peer
+	if _, err := conn.Write(socksReply(repSucceeded, peer.RemoteAddr())); err != nil {
+		s.debug.Println("bind:", err)
+		peer.Close()
+		return
+	}
+
+	s.applySocketOptions(conn)
+	s.applySocketOptions(peer)
+	start := s.now()
+	counter := s.routeCounter(RouteDirect)
+	s.relay(conn, peer, s.newTunnel(addr, counter))
+	s.debug.Println("closed bind connection from", peer.RemoteAddr())
+	s.summarize(addr, "", start, counter.stats())
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// blackHoleTimeout is how long a black holed connection is held open
+const blackHoleTimeout = time.Minute
+
+// BlockAction is what the service does with a request to a blocked
+// destination
+type BlockAction int
+
+// Actions on blocked destinations
+const (
+	// RejectWithReply send the "connection not allowed by ruleset" reply
+	// and close
+	RejectWithReply BlockAction = iota
+	// BlackHole reply success and silently drop whatever the client sends,
+	// which discourages clients retrying aggressively on failures
+	BlackHole
+)
+
+// SetBlockAction set how requests to blocked destinations are answered
+func (s *Service) SetBlockAction(action BlockAction) {
+	s.blockAction = action
+}
+
+// block answer a request to a blocked destination with reply, it must be
+// called before any reply is sent to the request
+func (s *Service) block(conn net.Conn, addr string, reply func(rep byte) error) {
+	s.debug.Println("blocked", addr)
+	switch s.blockAction {
+	case BlackHole:
+		if err := reply(repSucceeded); err != nil {
+			return
+		}
+		// the service stopping closes the connection, so that Stop does not
+		// wait for the black hole timeout
+		done := make(chan bool)
+		defer close(done)
+		go func() {
+			select {
+			case <-s.ch:
+				conn.Close()
+			case <-done:
+			}
+		}()
+		conn.SetReadDeadline(s.now().Add(blackHoleTimeout))
+		io.Copy(ioutil.Discard, conn)
+	default:
+		reply(repNotAllowed)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBlackHoleClosedOnStop(t *testing.T) {
+	s := &Service{ch: make(chan bool), now: time.Now}
+	s.SetBlockAction(BlackHole)
+	client, conn := net.Pipe()
+	defer client.Close()
+	done := make(chan bool)
+	go func() {
+		s.block(conn, "blocked.test:80", func(rep byte) error { return nil })
+		close(done)
+	}()
+	close(s.ch)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a black holed connection outlived the service")
+	}
+}
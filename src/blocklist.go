@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// destinationSet is a set of destinations. An entry is a domain, which
+// matches its subdomains too, an IP, a CIDR or a port written ":25".
+type destinationSet struct {
+	rules *ruleList
+	ports map[int]bool
+}
+
+func newDestinationSet(entries ...string) (*destinationSet, error) {
+	d := &destinationSet{rules: newRuleList(), ports: make(map[int]bool)}
+	for _, entry := range entries {
+		if err := d.add(entry); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *destinationSet) add(entry string) error {
+	if strings.HasPrefix(entry, ":") {
+		port, err := strconv.Atoi(entry[1:])
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port %q", entry)
+		}
+		d.ports[port] = true
+		return nil
+	}
+	return d.rules.add(entry)
+}
+
+func (d *destinationSet) match(host string, port int) bool {
+	return d.ports[port] || d.rules.match(host)
+}
+
+// Blocklist is the destinations refused by the service, whatever the
+// routers decide. An entry is a domain, which blocks its subdomains too, an
+// IP, a CIDR or a port written ":25".
+type Blocklist struct {
+	*destinationSet
+}
+
+// NewBlocklist return a blocklist of entries
+func NewBlocklist(entries ...string) (*Blocklist, error) {
+	d, err := newDestinationSet(entries...)
+	if err != nil {
+		return nil, err
+	}
+	return &Blocklist{d}, nil
+}
+
+// LoadBlocklist read a blocklist file, one entry per line, lines starting
+// with # are comments
+func LoadBlocklist(path string) (*Blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, _ := NewBlocklist()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if err := b.add(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Route reject the destinations of the blocklist
+func (b *Blocklist) Route(host string, port int) (Route, bool) {
+	if b.match(host, port) {
+		return RouteReject, true
+	}
+	return RouteProxy, false
+}
+
+// SetBlocklist set the destinations refused with the "connection not allowed
+// by ruleset" reply, or as set by SetBlockAction. It is checked before the
+// routers, nil removes it. Requests sniffed for their host were answered
+// already, see SetSniffing, they are reset instead.
+func (s *Service) SetBlocklist(b *Blocklist) {
+	s.blocklist = b
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+var errEmptyChain = errors.New("chain without hops")
+
+// chainDialer reach addresses through a chain of shadowsocks servers, each
+// hop tunnels to the next one and the last one to the address
+type chainDialer struct {
+	hops []*ServerCipher
+}
+
+// NewChainDialer return a dialer going through hops in order. Given to
+// SetProxyDialer, the servers of the service are reached through the last
+// hop, so the traffic crosses one more server for every hop.
+func NewChainDialer(hops ...*ServerCipher) ProxyDialer {
+	return &chainDialer{hops: hops}
+}
+
+func (d *chainDialer) Dial(network, addr string) (net.Conn, error) {
+	if len(d.hops) == 0 {
+		return nil, errEmptyChain
+	}
+	conn, err := d.hops[0].dial(proxyDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	for i, hop := range d.hops {
+		next := addr
+		if i+1 < len(d.hops) {
+			next = d.hops[i+1].server
+		}
+		rawaddr, err := ss.RawAddr(next)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if conn, err = sendRequest(conn, rawaddr, hop); err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
+}
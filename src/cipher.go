@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// streamMethods are the stream ciphers implemented by shadowsocks-go
+var streamMethods = []string{
+	"aes-128-cfb",
+	"aes-192-cfb",
+	"aes-256-cfb",
+	"aes-128-ctr",
+	"aes-192-ctr",
+	"aes-256-ctr",
+	"des-cfb",
+	"bf-cfb",
+	"cast5-cfb",
+	"rc4-md5",
+	"rc4-md5-6",
+	"chacha20",
+	"chacha20-ietf",
+	"salsa20",
+}
+
+// aeadMethods are the AEAD ciphers of the shadowsocks protocol
+var aeadMethods = []string{
+	"aes-128-gcm",
+	"aes-192-gcm",
+	"aes-256-gcm",
+	"chacha20-ietf-poly1305",
+	"xchacha20-ietf-poly1305",
+}
+
+// ss2022Methods are the ciphers of the Shadowsocks 2022 edition
+var ss2022Methods = []string{
+	"2022-blake3-aes-128-gcm",
+	"2022-blake3-aes-256-gcm",
+	"2022-blake3-chacha20-poly1305",
+}
+
+// Cipher encrypt the connections and packets exchanged with a server
+type Cipher interface {
+	StreamConn(conn net.Conn) net.Conn
+	PacketConn(pc net.PacketConn) net.PacketConn
+}
+
+// CipherFactory build the cipher of method keyed with password
+type CipherFactory func(method, password string) (Cipher, error)
+
+var (
+	ciphersMu sync.RWMutex
+	ciphers   = make(map[string]CipherFactory)
+)
+
+func init() {
+	stream := func(method, password string) (Cipher, error) {
+		c, err := ss.NewCipher(method, password)
+		if err != nil {
+			return nil, err
+		}
+		return streamCipher{c}, nil
+	}
+	aead := func(method, password string) (Cipher, error) {
+		if c := newAEADCipher(method, password); c != nil {
+			return c, nil
+		}
+		return nil, nil
+	}
+	ss2022 := func(method, password string) (Cipher, error) {
+		c, err := newSS2022Cipher(method, password)
+		if c == nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	for _, m := range streamMethods {
+		RegisterCipher(m, stream)
+	}
+	for _, m := range aeadMethods {
+		RegisterCipher(m, aead)
+	}
+	for _, m := range ss2022Methods {
+		RegisterCipher(m, ss2022)
+	}
+}
+
+// RegisterCipher make method available to NewServerCipher, replacing the
+// factory already registered with that name. Method names are case
+// insensitive.
+func RegisterCipher(method string, factory CipherFactory) {
+	ciphersMu.Lock()
+	defer ciphersMu.Unlock()
+	ciphers[strings.ToLower(method)] = factory
+}
+
+// SupportedMethods return the cipher methods which can be used to build a
+// ServerCipher, sorted by name
+func SupportedMethods() []string {
+	ciphersMu.RLock()
+	defer ciphersMu.RUnlock()
+	methods := make([]string, 0, len(ciphers))
+	for m := range ciphers {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// lookupCipher return the factory of method, the "-auth" suffix of one time
+// auth is allowed on stream ciphers
+func lookupCipher(method string) (CipherFactory, bool) {
+	ciphersMu.RLock()
+	defer ciphersMu.RUnlock()
+	name := strings.ToLower(method)
+	if factory, ok := ciphers[name]; ok {
+		return factory, true
+	}
+	if base := strings.TrimSuffix(name, "-auth"); base != name {
+		for _, m := range streamMethods {
+			if m == base {
+				return ciphers[base], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// streamCipher is a stream cipher implemented by shadowsocks-go
+type streamCipher struct {
+	*ss.Cipher
+}
+
+func (c streamCipher) StreamConn(conn net.Conn) net.Conn {
+	return ss.NewConn(conn, c.Copy())
+}
+
+func (c streamCipher) PacketConn(pc net.PacketConn) net.PacketConn {
+	return ss.NewSecurePacketConn(pc, c.Copy(), false)
+}
+
+// NewServerCipher create a ServerCipher for server with the given method and
+// password, the method is resolved among the registered ciphers
+func NewServerCipher(server, method, password string) (*ServerCipher, error) {
+	factory, ok := lookupCipher(method)
+	if !ok {
+		return nil, fmt.Errorf("cipher %s: unsupported method, use one of %s",
+			method, strings.Join(SupportedMethods(), ", "))
+	}
+	cipher, err := factory(strings.ToLower(method), password)
+	if err == nil && cipher == nil {
+		err = errors.New("unsupported method")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cipher %s: %v", method, err)
+	}
+	if _, ok := cipher.(*ss2022Cipher); !ok {
+		// the 2022 stream only plays the client, it can't decrypt itself
+		if err := selfTest(cipher); err != nil {
+			return nil, fmt.Errorf("cipher %s: self test: %v", method, err)
+		}
+	}
+	return &ServerCipher{server: server, cipher: cipher}, nil
+}
+
+// selfTest encrypt and decrypt a message with cipher, so a broken cipher is
+// reported when it is built instead of as garbage on every connection
+func selfTest(cipher Cipher) error {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	enc := cipher.StreamConn(a)
+	dec := cipher.StreamConn(b)
+
+	probe := []byte("shadowsocks cipher self test")
+	errc := make(chan error, 1)
+	go func() {
+		_, err := enc.Write(probe)
+		errc <- err
+	}()
+	buf := make([]byte, len(probe))
+	if _, err := io.ReadFull(dec, buf); err != nil {
+		return err
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+	if !bytes.Equal(buf, probe) {
+		return errors.New("decrypted data differs")
+	}
+	return nil
+}
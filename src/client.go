@@ -1,46 +1,287 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/binary"
 	"errors"
 	"io"
 	"net"
+	"os"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
 )
 
 const (
+	socksVer4       = 4
 	socksVer5       = 5
 	socksCmdConnect = 1
+	socksCmdBind    = 2
+	socksCmdUDP     = 3
 	directionOutput = 0
 	directionInput  = 1
+
+	methodNoAuth       = 0
+	methodUserPass     = 2
+	methodNoAcceptable = 0xff
+
+	userPassVer     = 1
+	userPassSuccess = 0
+	userPassFailure = 1
+
+	typeIPv4 = 1 // type is ipv4 address
+	typeDm   = 3 // type is domain address
+	typeIPv6 = 4 // type is ipv6 address
+
+	// reply field of socks replies
+	repSucceeded            = 0
+	repGeneralFailure       = 1
+	repNotAllowed           = 2
+	repNetworkUnreachable   = 3
+	repHostUnreachable      = 4
+	repConnectionRefused    = 5
+	repTTLExpired           = 6
+	repCommandNotSupported  = 7
+	repAddrTypeNotSupported = 8
+
+	defaultFallbackDelay    = 300 * time.Millisecond
+	defaultHandshakeTimeout = 30 * time.Second
+	defaultWriteTimeout     = 10 * time.Second
+	directDialTimeout       = 10 * time.Second
+	minSerialDialTimeout    = 2 * time.Second
+	maxDialTime             = 30 * time.Second
+	defaultDataReadTimeout  = 5 * time.Second
+	defaultAcceptPoll       = time.Second
+	acceptMinDelay          = 5 * time.Millisecond
+
+	spliceChunkSize = 64 * 1024
+)
+
+// SocksErrorCode identify a socks protocol error
+type SocksErrorCode int
+
+// Codes of SocksError
+const (
+	CodeAddrType SocksErrorCode = iota + 1
+	CodeVersion
+	CodeMethod
+	CodeAuthExtraData
+	CodeReqExtraData
+	CodeCommand
+	CodeDomainLength
+	CodeNoAcceptableMethod
+	CodeAuthFailed
+)
+
+// SocksError is an error in the request of a socks client
+type SocksError struct {
+	Code SocksErrorCode
+	msg  string
+}
+
+func (e *SocksError) Error() string {
+	return e.msg
+}
+
+// Errors of socks clients, their messages are stable
+var (
+	ErrAddrType           = &SocksError{CodeAddrType, "socks addr type not supported"}
+	ErrVer                = &SocksError{CodeVersion, "socks version not supported"}
+	ErrMethod             = &SocksError{CodeMethod, "socks only support 1 method now"}
+	ErrAuthExtraData      = &SocksError{CodeAuthExtraData, "socks authentication get extra data"}
+	ErrReqExtraData       = &SocksError{CodeReqExtraData, "socks request get extra data"}
+	ErrCmd                = &SocksError{CodeCommand, "socks command not supported"}
+	ErrDomainLen          = &SocksError{CodeDomainLength, "socks request invalid domain length"}
+	ErrNoAcceptableMethod = &SocksError{CodeNoAcceptableMethod, "socks no acceptable authentication method"}
+	ErrAuthFailed         = &SocksError{CodeAuthFailed, "socks username/password authentication failed"}
 )
 
 var (
-	errAddrType      = errors.New("socks addr type not supported")
-	errVer           = errors.New("socks version not supported")
-	errMethod        = errors.New("socks only support 1 method now")
-	errAuthExtraData = errors.New("socks authentication get extra data")
-	errReqExtraData  = errors.New("socks request get extra data")
-	errCmd           = errors.New("socks command not supported")
+	errNoServer    = errors.New("no server configured")
+	errNoUDPServer = errors.New("no server relays udp packets")
 )
 
+// Logger is where the service writes its access log, *log.Logger fits
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
 // Service is a tcp proxy service
 type Service struct {
-	ch              chan bool
-	waitGroup       *sync.WaitGroup
-	serverCipher    *ServerCipher
-	debug           ss.DebugLog
-	trafficListener TrafficListener
+	ch               chan bool
+	waitGroup        *sync.WaitGroup
+	serversMu        sync.RWMutex
+	servers          []*ServerCipher
+	static           []*ServerCipher            // servers set by ReloadServers
+	subscribed       map[string][]*ServerCipher // servers of each subscription
+	balancer         LoadBalancer
+	debug            ss.DebugLog
+	trafficListener  TrafficListener
+	closeListener    ConnCloseListener
+	latencyListener  LatencyListener
+	fallbackDelay    time.Duration
+	handshakeTimeout time.Duration
+	fastOpen         bool
+	writeTimeout     time.Duration
+	readTimeout      time.Duration
+	acceptPoll       time.Duration
+	errCh            chan error
+	maxConnLifetime  time.Duration
+	events           chan ConnEvent
+	limiter          *rateLimiter
+	portPriority     map[int]int
+	maxPriority      int
+	dialRetries      int
+	dialRetryBase    time.Duration
+	failover         int
+	codec            Codec
+	eagerReply       bool
+	adaptiveBuffers  bool
+	logger           Logger
+	accessLog        bool
+	now              func() time.Time
+	sockOpts         SocketOptions
+	blockAction      BlockAction
+	guard            *handshakeGuard
+	handshakes       *handshakeCounter
+	addrRewriter     func(host string, rawaddr []byte) []byte
+	commands         []byte
+	username         string
+	password         string
+	closing          chan bool
+	closeOnce        sync.Once
+	serveOnce        sync.Once
+	listenersMu      sync.Mutex
+	listeners        map[*net.TCPListener]bool
+	pool             *serverPool
+	mux              *muxPool
+	proxyDialer      ProxyDialer
+	routers          []Router
+	bypassLAN        bool
+	blocklist        *Blocklist
+	allowedClients   []*net.IPNet
+	fallback         *directFallback
+	remoteDNS        bool
+	sniff            bool
+	resolver         Resolver
+	dnsCache         *DNSCache
+	fakeIP           *FakeIPPool
+	hosts            *Hosts
+	healthMu         sync.RWMutex
+	health           map[string]*ServerHealth
+	probing          map[string]bool
+	healthSink       func(HealthSnapshot)
+	healthStop       chan bool
+	routeStats       []*trafficCounter
+	statsMu          sync.Mutex
+	serverStats      map[string]*trafficCounter
+	throughput       *throughputMeter
 }
 
 // ServerCipher shadowsock servier chipher
 type ServerCipher struct {
-	server string
-	cipher *ss.Cipher
+	server     string
+	cipher     Cipher
+	weight     int
+	plugin     string
+	pluginOpts string
+	pluginMu   sync.Mutex
+	pluginProc *pluginProcess
+	transport  Transport
+	tcpOnly    bool // relays udp over tcp, so udp isn't sent to it
+}
+
+// Weight return the share of connections the server gets from a weighted
+// balancer, 1 by default. The latency balancer divides the latency of the
+// server by it.
+func (sc *ServerCipher) Weight() int {
+	if sc.weight <= 0 {
+		return 1
+	}
+	return sc.weight
+}
+
+// SetWeight set the weight of the server, see Weight, it must be set before
+// the server is given to a Service
+func (sc *ServerCipher) SetWeight(weight int) {
+	sc.weight = weight
+}
+
+// Plugin return the SIP003 plugin of the server and its options, empty when
+// the server is reached directly
+func (sc *ServerCipher) Plugin() (name, opts string) {
+	return sc.plugin, sc.pluginOpts
+}
+
+// SetPlugin set the SIP003 plugin of the server, it must be set before the
+// server is given to a Service
+func (sc *ServerCipher) SetPlugin(name, opts string) {
+	sc.plugin = name
+	sc.pluginOpts = opts
+	sc.transport = builtinPlugin(name, opts)
+}
+
+// TrafficStats is the number of bytes sent and received
+type TrafficStats struct {
+	Sent     uint64
+	Received uint64
+}
+
+// Route is the path a tunnel takes to its destination
+type Route int
+
+// Routes of tunnels
+const (
+	RouteProxy Route = iota
+	RouteDirect
+	// RouteReject refuses the request, nothing goes through it
+	RouteReject
+)
+
+func (r Route) String() string {
+	switch r {
+	case RouteProxy:
+		return "proxy"
+	case RouteDirect:
+		return "direct"
+	case RouteReject:
+		return "reject"
+	}
+	return "unknown"
+}
+
+// trafficCounter is updated atomically by the pipes of a connection, bytes
+// are also added to parent if it is set
+type trafficCounter struct {
+	sent     uint64
+	received uint64
+	parent   *trafficCounter
+}
+
+func (c *trafficCounter) add(directionFlag, n int) {
+	switch directionFlag {
+	case directionOutput:
+		atomic.AddUint64(&c.sent, uint64(n))
+	case directionInput:
+		atomic.AddUint64(&c.received, uint64(n))
+	}
+	if c.parent != nil {
+		c.parent.add(directionFlag, n)
+	}
+}
+
+func (c *trafficCounter) stats() TrafficStats {
+	return TrafficStats{
+		Sent:     atomic.LoadUint64(&c.sent),
+		Received: atomic.LoadUint64(&c.received),
+	}
 }
 
 // TrafficListener listen sent/received traffic
@@ -49,16 +290,56 @@ type TrafficListener interface {
 	Received(int)
 }
 
+// LatencyListener listen the time between the server connection being
+// established and the first byte received from it
+type LatencyListener interface {
+	FirstByte(server string, latency time.Duration)
+}
+
+// ConnSummary describe a finished tunnel
+type ConnSummary struct {
+	Destination string
+	Server      string
+	Duration    time.Duration
+	Sent        uint64
+	Received    uint64
+}
+
+// ConnCloseListener is notified once for every tunnel when it is closed
+type ConnCloseListener interface {
+	ConnClosed(ConnSummary)
+}
+
 // NewService return a proxy service
 func NewService(serverCipher *ServerCipher) *Service {
 	s := &Service{
-		make(chan bool),
-		&sync.WaitGroup{},
-		serverCipher,
-		true,
-		nil,
+		ch:               make(chan bool),
+		closing:          make(chan bool),
+		waitGroup:        &sync.WaitGroup{},
+		servers:          []*ServerCipher{serverCipher},
+		static:           []*ServerCipher{serverCipher},
+		debug:            true,
+		fallbackDelay:    defaultFallbackDelay,
+		handshakeTimeout: defaultHandshakeTimeout,
+		writeTimeout:     defaultWriteTimeout,
+		readTimeout:      defaultDataReadTimeout,
+		acceptPoll:       defaultAcceptPoll,
+		errCh:            make(chan error, 16),
+		listeners:        make(map[*net.TCPListener]bool),
+		health:           make(map[string]*ServerHealth),
+		probing:          make(map[string]bool),
+		events:           make(chan ConnEvent, eventsBufferSize),
+		maxPriority:      1,
+		eagerReply:       true,
+		logger:           logger,
+		now:              time.Now,
+		handshakes:       &handshakeCounter{},
+		routeStats:       []*trafficCounter{RouteProxy: {}, RouteDirect: {}, RouteReject: {}},
+		serverStats:      make(map[string]*trafficCounter),
+		throughput:       &throughputMeter{},
 	}
 	s.waitGroup.Add(1)
+	go s.sampleThroughput()
 	return s
 }
 
@@ -67,36 +348,443 @@ func (s *Service) SetTrafficListener(listener TrafficListener) {
 	s.trafficListener = listener
 }
 
-// Serve to serve a listener
-func (s *Service) Serve(listener *net.TCPListener) {
+// SetConnCloseListener set close listener in service
+func (s *Service) SetConnCloseListener(listener ConnCloseListener) {
+	s.closeListener = listener
+}
+
+// SetLatencyListener set latency listener in service
+func (s *Service) SetLatencyListener(listener LatencyListener) {
+	s.latencyListener = listener
+}
+
+// SetFallbackDelay set the stagger between IPv6 and IPv4 attempts when
+// dialing a direct destination, zero means the default delay
+func (s *Service) SetFallbackDelay(d time.Duration) {
+	if d <= 0 {
+		d = defaultFallbackDelay
+	}
+	s.fallbackDelay = d
+}
+
+// SetHandshakeTimeout set the read timeout used while negotiating with a
+// socks client, zero means no timeout
+func (s *Service) SetHandshakeTimeout(d time.Duration) {
+	s.handshakeTimeout = d
+}
+
+// SetWriteTimeout set how long a write to either side of a tunnel may block
+// before the tunnel is torn down, zero means no timeout
+func (s *Service) SetWriteTimeout(d time.Duration) {
+	s.writeTimeout = d
+}
+
+// SetDataReadTimeout set how long a tunnel waits for data before checking
+// whether the service is stopping, zero means the default 5s
+func (s *Service) SetDataReadTimeout(d time.Duration) {
+	if d <= 0 {
+		d = defaultDataReadTimeout
+	}
+	s.readTimeout = d
+}
+
+// SetAcceptPollInterval set the longest wait between accept attempts after
+// temporary errors such as running out of file descriptors, zero means the
+// default 1s. Accept doesn't poll otherwise, Stop wakes it up directly.
+func (s *Service) SetAcceptPollInterval(d time.Duration) {
+	if d <= 0 {
+		d = defaultAcceptPoll
+	}
+	s.acceptPoll = d
+}
+
+// SetMaxConnLifetime set how long a tunnel may exist before it is closed,
+// even while transferring, zero means no limit
+func (s *Service) SetMaxConnLifetime(d time.Duration) {
+	s.maxConnLifetime = d
+}
+
+// SetDialRetries set how many times a failed dial to the servers is retried,
+// waiting base before the first retry and doubling it every time. Zero
+// retries means the client gets a failure at once.
+func (s *Service) SetDialRetries(n int, base time.Duration) {
+	s.dialRetries = n
+	s.dialRetryBase = base
+}
+
+// SetFailover set how many other servers are tried at once, before any
+// retry, when the dial to a server fails. The failed server is considered
+// down for a while, so the next connections avoid it too.
+func (s *Service) SetFailover(attempts int) {
+	s.failover = attempts
+}
+
+// SetEagerReply set whether to tell the client its connect request succeeded
+// before dialing the server. It saves a round trip, but when the dial fails
+// the client only sees the connection reset. Without it the client gets a
+// failure reply instead. Direct connections tell when the host is
+// unreachable, the connection was refused or the dial timed out. Proxied
+// ones get a general failure, the servers don't tell why they failed to
+// connect to the destination and failing to reach a server says nothing
+// about it. Requests answered early for sniffing, see SetSniffing, are reset
+// on failure whatever the setting. It is on by default.
+func (s *Service) SetEagerReply(eager bool) {
+	s.eagerReply = eager
+}
+
+// SetAdaptiveBuffers set whether pipes start with a small read buffer and
+// grow it only while they are busy, instead of always using a leaky buffer.
+// It lowers memory use with many idle tunnels at the cost of more
+// allocations.
+func (s *Service) SetAdaptiveBuffers(enable bool) {
+	s.adaptiveBuffers = enable
+}
+
+// SetLogger set the logger of the access log
+func (s *Service) SetLogger(l Logger) {
+	s.logger = l
+}
+
+// SetAccessLog set whether to log one line for each tunnel with its
+// destination and server, regardless of debug output
+func (s *Service) SetAccessLog(enable bool) {
+	s.accessLog = enable
+}
+
+// setClock replace the time source of deadlines, limiters and health, so
+// tests of time based features can use a fake clock. It must be called
+// before the service is used.
+func (s *Service) setClock(now func() time.Time) {
+	s.now = now
+	if s.limiter != nil {
+		s.limiter.now = now
+		s.limiter.last = now()
+	}
+}
+
+// SetAddrRewriter set a function consulted before dialing, which may return
+// another raw socks address for the destination host (host:port). Returning
+// rawaddr unchanged is a no-op.
+func (s *Service) SetAddrRewriter(rewriter func(host string, rawaddr []byte) []byte) {
+	s.addrRewriter = rewriter
+}
+
+// SetCredentials require socks clients to authenticate with username and
+// password (RFC 1929) and http clients with the same basic credentials. An
+// empty username disables authentication.
+func (s *Service) SetCredentials(username, password string) {
+	s.username = username
+	s.password = password
+}
+
+// SetEnabledCommands set the socks commands clients may use, others are
+// refused with a command not supported reply. Nil enables every command
+// the service supports.
+func (s *Service) SetEnabledCommands(cmds []byte) {
+	if cmds != nil {
+		cmds = append([]byte{}, cmds...)
+	}
+	s.commands = cmds
+}
+
+// commandEnabled report whether clients may use the socks command cmd
+func (s *Service) commandEnabled(cmd byte) bool {
+	if cmd != socksCmdConnect && cmd != socksCmdBind && cmd != socksCmdUDP {
+		return false
+	}
+	if s.commands == nil {
+		return true
+	}
+	for _, c := range s.commands {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTCPFastOpen set whether to use TCP Fast Open when dialing the server,
+// the socks request is then sent in the SYN. It is supported on Linux and
+// macOS and a no-op elsewhere, dials fail if the kernel rejects the option.
+func (s *Service) SetTCPFastOpen(enable bool) {
+	s.fastOpen = enable
+}
+
+// UpdateServer switch new connections to serverCipher alone, e.g. after its
+// password changed. It is safe to call while serving.
+func (s *Service) UpdateServer(serverCipher *ServerCipher) {
+	s.ReloadServers([]*ServerCipher{serverCipher})
+}
+
+// ReloadServers replace the servers used by new connections, tunnels which
+// are already established keep their server. The plugins of the servers
+// kept, with the same plugin and options, keep running. The servers of the
+// subscriptions stay, after servers.
+func (s *Service) ReloadServers(servers []*ServerCipher) error {
+	if len(servers) == 0 {
+		return errNoServer
+	}
+	s.serversMu.Lock()
+	s.static = append([]*ServerCipher(nil), servers...)
+	old, list := s.setServers()
+	s.serversMu.Unlock()
+	handOverPlugins(old, list)
+	stopPlugins(old, list)
+	return nil
+}
+
+// setServers use the static servers followed by the servers of the
+// subscriptions, it must be called with serversMu locked
+func (s *Service) setServers() (old, list []*ServerCipher) {
+	list = append([]*ServerCipher(nil), s.static...)
+	urls := make([]string, 0, len(s.subscribed))
+	for url := range s.subscribed {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	for _, url := range urls {
+		list = append(list, s.subscribed[url]...)
+	}
+	old = s.servers
+	s.servers = list
+	return old, list
+}
+
+// SetServerPoolSize set how many connections to each server are dialed
+// ahead of time so new tunnels don't wait for the tcp handshake, zero
+// disables the pool
+func (s *Service) SetServerPoolSize(n int) {
+	if s.pool != nil {
+		s.pool.drain()
+		s.pool = nil
+	}
+	if n > 0 {
+		s.pool = newServerPool(n, s.dialServerConn)
+	}
+}
+
+// Stats return traffic of all tunnels
+func (s *Service) Stats() TrafficStats {
+	proxy := s.RouteStats(RouteProxy)
+	direct := s.RouteStats(RouteDirect)
+	return TrafficStats{
+		Sent:     proxy.Sent + direct.Sent,
+		Received: proxy.Received + direct.Received,
+	}
+}
+
+// RouteStats return traffic of the tunnels which took route, only proxied
+// traffic goes through the servers
+func (s *Service) RouteStats(route Route) TrafficStats {
+	return s.routeStats[route].stats()
+}
+
+// routeCounter return a new counter for a tunnel taking route
+func (s *Service) routeCounter(route Route) *trafficCounter {
+	return &trafficCounter{parent: s.routeStats[route]}
+}
+
+// ServerStats return traffic of each server keyed by server address
+func (s *Service) ServerStats() map[string]TrafficStats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	stats := make(map[string]TrafficStats, len(s.serverStats))
+	for server, counter := range s.serverStats {
+		stats[server] = counter.stats()
+	}
+	return stats
+}
+
+// serverCounter return the traffic counter of server, creating it if needed
+func (s *Service) serverCounter(server string) *trafficCounter {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	counter, ok := s.serverStats[server]
+	if !ok {
+		counter = &trafficCounter{parent: s.routeStats[RouteProxy]}
+		s.serverStats[server] = counter
+	}
+	return counter
+}
+
+// Serve to serve a listener, it returns nil when the service stops or the
+// error which broke the listener
+func (s *Service) Serve(listener *net.TCPListener) error {
+	return s.ServeAll(listener)
+}
+
+// ServeAll to serve several listeners at once, they share the same server,
+// stats and lifecycle so a single Stop closes all of them. It returns when
+// every listener is done, with the first error which broke one of them.
+// Errors are also sent to Errors as soon as they happen.
+func (s *Service) ServeAll(listeners ...*net.TCPListener) error {
+	return s.serve(s.handleConnection, listeners)
+}
+
+// serve run the accept loops of listeners, passing connections to handle.
+// It may be called several times, e.g. for socks and http listeners.
+func (s *Service) serve(handle func(net.Conn), listeners []*net.TCPListener) error {
+	s.waitGroup.Add(1)
 	defer s.waitGroup.Done()
+	// NewService holds the wait group until the service is served
+	s.serveOnce.Do(s.waitGroup.Done)
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func(listener *net.TCPListener) {
+			defer wg.Done()
+			if err := s.acceptLoop(listener, handle); err != nil {
+				errs <- err
+				select {
+				case s.errCh <- err:
+				default:
+				}
+			}
+		}(listener)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// Errors return a channel receiving the errors which broke a listener, so a
+// supervisor can restart it
+func (s *Service) Errors() <-chan error {
+	return s.errCh
+}
+
+// acceptLoop accept connections from listener until the service stops or
+// the listener fails, and pass them to handle. Stop closes the listener to
+// wake up Accept.
+func (s *Service) acceptLoop(listener *net.TCPListener, handle func(net.Conn)) error {
+	if !s.trackListener(listener, true) {
+		listener.Close()
+		return nil
+	}
+	defer s.untrackListener(listener)
+
+	var delay time.Duration // backoff after temporary errors
+	var logged time.Time
 	for {
+		conn, err := listener.Accept()
 		select {
-		case <-s.ch:
+		case <-s.closing:
+			// shutting down, the error is from the closed listener
 			s.debug.Println("stopping listening on", listener.Addr())
-			listener.Close()
-			return
+			if err == nil {
+				conn.Close()
+			}
+			return nil
 		default:
 		}
-		listener.SetDeadline(time.Now().Add(1e9))
-		conn, err := listener.Accept()
 		if err != nil {
-			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-				continue
-			} else {
-				s.debug.Println(err)
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				// e.g. too many open files, back off like net/http so the
+				// loop doesn't spin until descriptors are released
+				if delay == 0 {
+					delay = acceptMinDelay
+				} else if delay *= 2; delay > s.acceptPoll {
+					delay = s.acceptPoll
+				}
+				if time.Since(logged) >= s.acceptPoll {
+					s.debug.Printf("accept: %v, retrying in %v\n", err, delay)
+					logged = time.Now()
+				}
+				select {
+				case <-s.closing:
+				case <-time.After(delay):
+				}
 				continue
 			}
+			s.debug.Println("stopping listening on", listener.Addr(), err)
+			listener.Close()
+			return err
 		}
-		s.debug.Printf("socks connect from %s\n", conn.RemoteAddr().String())
+		delay = 0
+		if !s.clientAllowed(conn.RemoteAddr()) {
+			s.debug.Println("client not allowed:", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		s.debug.Printf("connect from %s\n", conn.RemoteAddr().String())
 		s.waitGroup.Add(1)
-		go s.handleConnection(conn)
+		go handle(conn)
 	}
 }
 
-// Stop is a graceful method to stop service
+// trackListener remember listener so Stop can close it, it returns false if
+// the service is already stopped. Accept listeners are also closed by
+// Quiesce, and refused once it is called.
+func (s *Service) trackListener(listener *net.TCPListener, accept bool) bool {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	done := s.ch
+	if accept {
+		done = s.closing
+	}
+	select {
+	case <-done:
+		return false
+	default:
+	}
+	s.listeners[listener] = accept
+	return true
+}
+
+func (s *Service) untrackListener(listener *net.TCPListener) {
+	s.listenersMu.Lock()
+	delete(s.listeners, listener)
+	s.listenersMu.Unlock()
+}
+
+// closeListeners stop accepting new connections
+func (s *Service) closeListeners() {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+	})
+	for listener, accept := range s.listeners {
+		if accept {
+			listener.Close()
+		}
+	}
+	if s.pool != nil {
+		s.pool.drain()
+	}
+	if s.mux != nil {
+		s.mux.close()
+	}
+}
+
+// Stop is a graceful method to stop service, the tunnels are closed and it
+// returns once they are done
 func (s *Service) Stop() {
+	s.listenersMu.Lock()
+	s.closeListeners()
 	close(s.ch)
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	s.listenersMu.Unlock()
+	// release the hold of NewService if the service was never served
+	s.serveOnce.Do(s.waitGroup.Done)
+	s.waitGroup.Wait()
+	s.serversMu.RLock()
+	stopPlugins(s.servers, nil)
+	s.serversMu.RUnlock()
+}
+
+// Quiesce stop accepting new connections but, unlike Stop, let the tunnels
+// run until they end on their own, use Wait to know when. Stop may still be
+// called afterwards to close them.
+func (s *Service) Quiesce() {
+	s.listenersMu.Lock()
+	s.closeListeners()
+	s.listenersMu.Unlock()
+}
+
+// Wait block until the listeners are closed and all the tunnels are done
+func (s *Service) Wait() {
 	s.waitGroup.Wait()
 }
 
@@ -106,46 +794,549 @@ func (s *Service) handleConnection(conn net.Conn) {
 		conn.Close()
 	}()
 
-	if err := s.handShake(conn); err != nil {
+	if !s.allowClient(conn.RemoteAddr()) {
+		s.debug.Println("too many failed handshakes from", conn.RemoteAddr())
+		return
+	}
+	remoteAddr := conn.RemoteAddr().String()
+	s.publish(ConnEvent{Type: ConnAccepted, Remote: remoteAddr})
+
+	// the version tells socks4 and socks5 clients apart
+	var ver [1]byte
+	s.setHandshakeDeadline(conn)
+	if _, err := io.ReadFull(conn, ver[:]); err != nil {
+		s.debug.Println("socks handshake:", err)
+		s.handshakeFailed(conn.RemoteAddr(), err)
+		s.publish(ConnEvent{Type: ConnHandshakeFailed, Remote: remoteAddr, Err: err})
+		return
+	}
+	if ver[0] == socksVer4 {
+		s.handleSocks4(conn)
+		return
+	}
+	if err := s.handShake(conn, ver[0]); err != nil {
 		s.debug.Println("socks handshake:", err)
+		s.handshakeFailed(conn.RemoteAddr(), err)
+		s.publish(ConnEvent{Type: ConnHandshakeFailed, Remote: remoteAddr, Err: err})
 		return
 	}
 
-	rawaddr, addr, err := s.getRequest(conn)
+	cmd, rawaddr, addr, err := s.getRequest(conn)
 	if err != nil {
 		s.debug.Println("error getting request:", err)
+		switch err {
+		case ErrCmd:
+			conn.Write(socksReply(repCommandNotSupported, unspecifiedAddr(conn)))
+		case ErrAddrType:
+			conn.Write(socksReply(repAddrTypeNotSupported, unspecifiedAddr(conn)))
+		default:
+			if _, ok := err.(*SocksError); ok {
+				conn.Write(socksReply(repGeneralFailure, unspecifiedAddr(conn)))
+			}
+		}
+		s.handshakeFailed(conn.RemoteAddr(), err)
+		s.publish(ConnEvent{Type: ConnHandshakeFailed, Remote: remoteAddr, Err: err})
 		return
 	}
-	// Sending connection established message immediately to client.
-	// This some round trip time for creating socks connection with the client.
-	// But if connection failed, the client will get connection reset error.
-	_, err = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x08, 0x43})
-	if err != nil {
-		s.debug.Println("send connection confirmation:", err)
+	switch cmd {
+	case socksCmdBind:
+		s.handleBind(conn, addr)
+		return
+	case socksCmdUDP:
+		s.handleUDPAssociate(conn, addr)
+		return
 	}
+	s.tunnelRequest(conn, rawaddr, addr, func(rep byte) error {
+		_, err := conn.Write(socksReply(rep, unspecifiedAddr(conn)))
+		return err
+	})
+}
 
-	s.debug.Printf("connected to %s via %s\n", addr, s.serverCipher.server)
+// tunnelRequest connect to addr through the servers and relay conn with it,
+// reply tells the client the outcome with a socks reply code
+func (s *Service) tunnelRequest(conn net.Conn, rawaddr []byte, addr string, reply func(rep byte) error) {
+	if (s.sniff || s.remoteDNS) && (rawaddr[0] == typeIPv4 || rawaddr[0] == typeIPv6) {
+		// the client only sends data once it got the reply, the later
+		// replies of failures are dropped and it sees the connection reset
+		reply = replyOnce(conn, reply)
+		if err := reply(repSucceeded); err != nil {
+			s.debug.Println("send connection confirmation:", err)
+			return
+		}
+		conn, rawaddr, addr = s.sniffRequest(conn, rawaddr, addr)
+	}
+	rawaddr, addr = s.overrideHost(rawaddr, addr)
+	switch s.route(addr) {
+	case RouteReject:
+		s.block(conn, addr, reply)
+		return
+	case RouteDirect:
+		s.tunnelDirect(conn, addr, reply)
+		return
+	}
+	if s.fallback != nil && s.fallback.active(addr, s.now()) {
+		s.debug.Println("servers unreachable, connecting directly to", addr)
+		s.tunnelDirect(conn, addr, reply)
+		return
+	}
+
+	remoteAddr := conn.RemoteAddr().String()
+	if s.eagerReply {
+		// Sending connection established message immediately to client.
+		// This some round trip time for creating socks connection with the client.
+		// But if connection failed, the client will get connection reset error.
+		if err := reply(repSucceeded); err != nil {
+			s.debug.Println("send connection confirmation:", err)
+		}
+	}
 
-	cipher := s.serverCipher.cipher
-	serverAddrPort := s.serverCipher.server
-	remote, err := ss.DialWithRawAddr(rawaddr, serverAddrPort, cipher.Copy())
+	if s.addrRewriter != nil {
+		rawaddr = s.addrRewriter(addr, rawaddr)
+	}
+	req := PickRequest{Client: remoteAddr, Destination: addr}
+	remote, serverCipher, err := s.connectTunnel(rawaddr, req)
+	serverAddrPort := serverCipher.server
+	if s.fallback != nil {
+		s.fallback.dialed(err, s.now())
+	}
 	if err != nil {
 		s.debug.Println(err)
+		if !s.eagerReply {
+			// err is about the server, not the destination
+			reply(repGeneralFailure)
+		}
+		return
+	}
+	s.publish(ConnEvent{
+		Type:        ConnEstablished,
+		Remote:      remoteAddr,
+		Destination: addr,
+		Server:      serverAddrPort,
+	})
+	if !s.eagerReply {
+		if err = reply(repSucceeded); err != nil {
+			s.debug.Println("send connection confirmation:", err)
+			remote.Close()
+			return
+		}
+	}
+	s.debug.Printf("connected to %s via %s\n", addr, serverAddrPort)
+	s.applySocketOptions(conn)
+	s.applySocketOptions(remote)
+	if s.accessLog {
+		s.logger.Printf("connected to %s via %s", addr, serverAddrPort)
+	}
+
+	start := s.now()
+	counter := &trafficCounter{parent: s.serverCounter(serverAddrPort)}
+	t := s.newTunnel(addr, counter)
+	t.server = serverAddrPort
+	t.established = start
+	s.relay(conn, remote, t)
+	s.debug.Println("closed connection to", addr)
+
+	stats := counter.stats()
+	s.publish(ConnEvent{
+		Type:        ConnClosed,
+		Remote:      remoteAddr,
+		Destination: addr,
+		Server:      serverAddrPort,
+		Sent:        stats.Sent,
+		Received:    stats.Received,
+	})
+	s.summarize(addr, serverAddrPort, start, stats)
+}
+
+// summarize notify the close listener of a tunnel to addr via server, empty
+// for direct tunnels, which started at start
+func (s *Service) summarize(addr, server string, start time.Time, stats TrafficStats) {
+	if s.closeListener == nil {
 		return
 	}
+	s.closeListener.ConnClosed(ConnSummary{
+		Destination: addr,
+		Server:      server,
+		Duration:    s.now().Sub(start),
+		Sent:        stats.Sent,
+		Received:    stats.Received,
+	})
+}
+
+// tunnel is the state shared by both directions of a relay
+type tunnel struct {
+	counter  *trafficCounter
+	priority int
+
+	// server and the time the server connection was established, to measure
+	// the time to first byte of proxied tunnels
+	server      string
+	established time.Time
+	firstByte   bool
+}
+
+func (s *Service) newTunnel(addr string, counter *trafficCounter) *tunnel {
+	return &tunnel{
+		counter:  counter,
+		priority: s.priority(addr),
+	}
+}
+
+// relay pipes data between the socks client conn and remote in both
+// directions, it returns when both directions are closed
+func (s *Service) relay(conn, remote net.Conn, t *tunnel) {
+	if s.maxConnLifetime > 0 {
+		timer := time.AfterFunc(s.maxConnLifetime, func() {
+			conn.Close()
+			remote.Close()
+		})
+		defer timer.Stop()
+	}
 
+	done := make(chan bool)
 	s.waitGroup.Add(1)
 	go func() {
 		defer s.waitGroup.Done()
+		defer close(done)
 		// remote to local
-		s.pipeThenClose(remote, conn, directionInput)
+		s.pipeThenClose(remote, conn, directionInput, t)
 	}()
 	// local to remote
-	s.pipeThenClose(conn, remote, directionOutput)
-	s.debug.Println("closed connection to", addr)
+	s.pipeThenClose(conn, remote, directionOutput, t)
+	<-done
+}
+
+// connectServer pick a server and dial it. When dial retries are enabled,
+// failed dials are retried with exponential backoff, picking the server
+// again each time, until the overall dial timeout or the service stops. The
+// last server tried is returned with the error.
+//
+// Every failed dial is logged, counted in the health of the server and
+// published as a ConnDialFailed event.
+func (s *Service) connectServer(rawaddr []byte, req PickRequest) (net.Conn, *ServerCipher, error) {
+	start := s.now()
+	backoff := s.dialRetryBase
+	tried := make(map[*ServerCipher]bool)
+	retries, failovers := 0, 0
+	for attempt := 0; ; attempt++ {
+		serverCipher := s.pickServer(req)
+		tried[serverCipher] = true
+		dialStart := s.now()
+		remote, err := s.dialServer(rawaddr, serverCipher)
+		s.recordHealth(serverCipher.server, s.now().Sub(dialStart), err)
+		if err == nil {
+			if attempt > 0 {
+				s.logger.Printf("dial %s via %s succeeded after %d failed attempts",
+					req.Destination, serverCipher.server, attempt)
+			}
+			return remote, serverCipher, nil
+		}
+
+		s.logger.Printf("dial %s via %s failed: %v", req.Destination, serverCipher.server, err)
+		s.publish(ConnEvent{
+			Type:        ConnDialFailed,
+			Remote:      req.Client,
+			Destination: req.Destination,
+			Server:      serverCipher.server,
+			Err:         err,
+		})
+		// the failed server is down now, try another one at once
+		if failovers < s.failover && s.untriedServer(tried) {
+			failovers++
+			continue
+		}
+		if retries >= s.dialRetries || s.now().Sub(start)+backoff > maxDialTime {
+			return nil, serverCipher, err
+		}
+		retries++
+		s.debug.Printf("dial %s: %v, retry in %v\n", serverCipher.server, err, backoff)
+		select {
+		case <-s.ch:
+			return nil, serverCipher, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// dialServer connects to the shadowsocks server and sends the request, on a
+// stream of a mux session if enabled
+func (s *Service) dialServer(rawaddr []byte, serverCipher *ServerCipher) (net.Conn, error) {
+	if s.mux != nil {
+		return s.mux.open(serverCipher.server, rawaddr, func() (net.Conn, error) {
+			return s.dialEncrypted(muxRawAddr, serverCipher)
+		})
+	}
+	return s.dialEncrypted(rawaddr, serverCipher)
+}
+
+// dialEncrypted open a connection to the shadowsocks server for rawaddr
+func (s *Service) dialEncrypted(rawaddr []byte, serverCipher *ServerCipher) (net.Conn, error) {
+	if s.pool != nil && serverCipher.plugin == "" && serverCipher.transport == nil && s.proxyDialer == nil {
+		if conn := s.pool.get(serverCipher.server); conn != nil {
+			return sendRequest(conn, rawaddr, serverCipher)
+		}
+	}
+	if stream, ok := serverCipher.cipher.(streamCipher); ok && !s.fastOpen &&
+		serverCipher.transport == nil && (s.proxyDialer == nil || serverCipher.plugin != "") {
+		// shadowsocks-go dials itself and adds the one time auth header if
+		// enabled, it gets the first address of the host
+		server, err := serverCipher.dialAddr()
+		if err != nil {
+			return nil, err
+		}
+		if server, err = s.resolveServer(s.overrideServer(server)); err != nil {
+			return nil, err
+		}
+		return ss.DialWithRawAddr(rawaddr, server, stream.Copy())
+	}
+	conn, err := s.dialConn(serverCipher, 0)
+	if err != nil {
+		return nil, err
+	}
+	return sendRequest(conn, rawaddr, serverCipher)
+}
+
+// dialConn open the connection to the server carrying the shadowsocks
+// stream, through its transport, its plugin or the proxy dialer if set
+func (s *Service) dialConn(serverCipher *ServerCipher, timeout time.Duration) (net.Conn, error) {
+	if serverCipher.transport != nil {
+		return serverCipher.transport.Dial(serverCipher.server)
+	}
+	server, err := serverCipher.dialAddr()
+	if err != nil {
+		return nil, err
+	}
+	if s.proxyDialer != nil && serverCipher.plugin == "" {
+		return s.proxyDialer.Dial("tcp", server)
+	}
+	return s.dialServerConn(server, timeout)
+}
+
+// dialServerConn open a tcp connection to server, its host overridden by the
+// hosts and resolved through the dns cache if set, with TCP Fast Open if
+// enabled
+func (s *Service) dialServerConn(server string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if s.fastOpen {
+		dialer.Control = fastOpenControl
+	}
+	return dialResolved(dialer, s.overrideServer(server), s.serverLookup())
+}
+
+// lookupIP resolve host with the resolver, or the system one, through the
+// dns cache if set
+func (s *Service) lookupIP(host string) ([]net.IP, error) {
+	r := s.resolver
+	if r == nil {
+		r = systemResolver{}
+	}
+	if s.dnsCache == nil {
+		return r.LookupIP(host)
+	}
+	return s.dnsCache.lookupIP(r, host, s.now())
+}
+
+// overrideServer return server with its host overridden by the hosts
+func (s *Service) overrideServer(server string) string {
+	if s.hosts == nil {
+		return server
+	}
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return server
+	}
+	if target, ok := s.hosts.lookup(host); ok {
+		return net.JoinHostPort(target, port)
+	}
+	return server
+}
+
+// serverLookup return how the hosts of the servers are resolved, through the
+// dns cache, nil to let the dialer resolve them
+func (s *Service) serverLookup() func(host string) ([]net.IP, error) {
+	if s.dnsCache == nil {
+		return nil
+	}
+	return func(host string) ([]net.IP, error) {
+		return s.dnsCache.lookupIP(systemResolver{}, host, s.now())
+	}
+}
+
+// resolveServer return server with its host resolved to its first address
+// through the dns cache, as is without a cache
+func (s *Service) resolveServer(server string) (string, error) {
+	host, port, err := net.SplitHostPort(server)
+	lookup := s.serverLookup()
+	if lookup == nil || err != nil || net.ParseIP(host) != nil {
+		return server, nil
+	}
+	ips, err := lookup(host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// sendRequest bind the cipher to a connection to the server and send the
+// target address
+func sendRequest(conn net.Conn, rawaddr []byte, serverCipher *ServerCipher) (net.Conn, error) {
+	remote := serverCipher.cipher.StreamConn(conn)
+	if _, err := remote.Write(rawaddr); err != nil {
+		remote.Close()
+		return nil, err
+	}
+	return remote, nil
+}
+
+// dialDirect connects to addr without the shadowsocks server. When the host
+// has both A and AAAA records the two families race (RFC 8305), the loser is
+// cancelled. Hosts are resolved with the resolver or the dns cache if set.
+func (s *Service) dialDirect(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:       directDialTimeout,
+		FallbackDelay: s.fallbackDelay,
+	}
+	var lookup func(host string) ([]net.IP, error)
+	if s.resolver != nil || s.dnsCache != nil {
+		lookup = s.lookupIP
+	}
+	return dialResolved(dialer, addr, lookup)
+}
+
+// dialResolved dial addr with dialer, its host resolved with lookup if set
+// and its addresses racing as in dialIPs, the dialer resolves it otherwise
+func dialResolved(dialer *net.Dialer, addr string, lookup func(host string) ([]net.IP, error)) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if lookup == nil || err != nil || net.ParseIP(host) != nil {
+		return dialer.Dial("tcp", addr)
+	}
+	ips, err := lookup(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return dialIPs(dialer, ips, port)
+}
+
+// dialIPs dial port on ips, the addresses of a host, like dialer does for the
+// hosts it resolves itself. The family of the first address is tried first
+// and the other one joins the race after the fallback delay, or as soon as
+// the first one failed (RFC 8305). The addresses of a family are tried in
+// turn, sharing the timeout of dialer.
+func dialIPs(dialer *net.Dialer, ips []net.IP, port string) (net.Conn, error) {
+	var primaries, fallbacks []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (ips[0].To4() != nil) {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if dialer.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, dialer.Timeout)
+		defer cancel()
+	}
+	if len(fallbacks) == 0 {
+		return dialSerial(ctx, dialer, primaries, port)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	pending := 0
+	race := func(ips []net.IP) {
+		pending++
+		go func() {
+			conn, err := dialSerial(ctx, dialer, ips, port)
+			results <- result{conn, err}
+		}()
+	}
+	delay := dialer.FallbackDelay
+	if delay <= 0 {
+		delay = defaultFallbackDelay
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	race(primaries)
+	fallbackStarted := false
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				race(fallbacks)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// the loser may connect before it sees the cancellation
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if !fallbackStarted {
+				fallbackStarted = true
+				race(fallbacks)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
 }
 
-func (s *Service) handShake(conn net.Conn) (err error) {
+// dialSerial dial port on ips in turn until one answers, the addresses left
+// share the time until the deadline of ctx
+func dialSerial(ctx context.Context, dialer *net.Dialer, ips []net.IP, port string) (net.Conn, error) {
+	var err error
+	for i, ip := range ips {
+		dialCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout := time.Until(deadline) / time.Duration(len(ips)-i)
+			if timeout < minSerialDialTimeout {
+				timeout = minSerialDialTimeout
+			}
+			dialCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		var conn net.Conn
+		conn, err = dialer.DialContext(dialCtx, "tcp", net.JoinHostPort(ip.String(), port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// setHandshakeDeadline apply the handshake read timeout to conn
+func (s *Service) setHandshakeDeadline(conn net.Conn) {
+	if s.handshakeTimeout > 0 {
+		conn.SetReadDeadline(s.now().Add(s.handshakeTimeout))
+	} else {
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// handShake negotiate the authentication method with a socks client whose
+// version byte ver was already read
+func (s *Service) handShake(conn net.Conn, ver byte) (err error) {
 	const (
 		idVer     = 0
 		idNmethod = 1
@@ -155,16 +1346,19 @@ func (s *Service) handShake(conn net.Conn) (err error) {
 	// the current rfc defines only 3 authentication methods (plus 2 reserved),
 	// so it won't be such long in practice
 
-	buf := make([]byte, 258)
+	buf := handshakeBufPool.Get().([]byte)[:258]
+	defer handshakeBufPool.Put(buf[:handshakeBufSize])
 
 	var n int
-	ss.SetReadTimeout(conn)
+	s.setHandshakeDeadline(conn)
 	// make sure we get the nmethod field
-	if n, err = io.ReadAtLeast(conn, buf, idNmethod+1); err != nil {
+	buf[idVer] = ver
+	if n, err = io.ReadAtLeast(conn, buf[idNmethod:], 1); err != nil {
 		return
 	}
+	n++
 	if buf[idVer] != socksVer5 {
-		return errVer
+		return ErrVer
 	}
 	nmethod := int(buf[idNmethod])
 	msgLen := nmethod + 2
@@ -175,14 +1369,136 @@ func (s *Service) handShake(conn net.Conn) (err error) {
 			return
 		}
 	} else { // error, should not get extra data
-		return errAuthExtraData
+		return ErrAuthExtraData
+	}
+	method := byte(methodNoAuth)
+	if s.username != "" {
+		method = methodUserPass
+	}
+	// tell the client at once if it doesn't offer the method we require
+	// (e.g. GSSAPI only) instead of letting it hang
+	if bytes.IndexByte(buf[idNmethod+1:msgLen], method) < 0 {
+		conn.Write([]byte{socksVer5, methodNoAcceptable})
+		return ErrNoAcceptableMethod
+	}
+	// send confirmation: version 5 and the selected method
+	if _, err = conn.Write([]byte{socksVer5, method}); err != nil {
+		return
+	}
+	if method == methodUserPass {
+		return s.authenticate(conn)
+	}
+	return
+}
+
+// authenticate run the username/password subnegotiation of RFC 1929
+func (s *Service) authenticate(conn net.Conn) (err error) {
+	// VER ULEN UNAME PLEN PASSWD, each field at most 255 bytes
+	var buf [255]byte
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if buf[0] != userPassVer {
+		return ErrVer
+	}
+	username := make([]byte, buf[1])
+	if _, err = io.ReadFull(conn, username); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+		return
+	}
+	password := buf[:buf[0]]
+	if _, err = io.ReadFull(conn, password); err != nil {
+		return
 	}
-	// send confirmation: version 5, no authentication required
-	_, err = conn.Write([]byte{socksVer5, 0})
+	if !s.checkCredentials(string(username), string(password)) {
+		conn.Write([]byte{userPassVer, userPassFailure})
+		return ErrAuthFailed
+	}
+	_, err = conn.Write([]byte{userPassVer, userPassSuccess})
 	return
 }
 
-func (s *Service) getRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
+// checkCredentials report whether username and password are the configured
+// ones, in constant time
+func (s *Service) checkCredentials(username, password string) bool {
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(s.username))
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.password))
+	return userOK&passOK == 1
+}
+
+// handshakeBufSize fits both the method selection message (258 bytes) and
+// the request (263 bytes)
+const handshakeBufSize = 263
+
+// handshakeBufPool hold the buffers of handShake and getRequest, apart from
+// the leaky buffer of the pipes
+var handshakeBufPool = sync.Pool{
+	New: func() interface{} { return make([]byte, handshakeBufSize) },
+}
+
+// unspecifiedAddr return the unspecified address of the family of the client
+// connection, for replies to requests whose bound address means nothing to
+// the client. Some ipv6 clients reject an ipv4 bound address.
+func unspecifiedAddr(conn net.Conn) net.Addr {
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		return &net.TCPAddr{IP: net.IPv6unspecified}
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+// socksReply build a socks reply, the bound address is addr or the zero
+// ipv4 address if addr is nil
+func socksReply(rep byte, addr net.Addr) []byte {
+	ip := net.IPv4zero
+	port := 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	reply := []byte{socksVer5, rep, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(reply, typeIPv4)
+		reply = append(reply, ip4...)
+	} else {
+		reply = append(reply, typeIPv6)
+		reply = append(reply, ip.To16()...)
+	}
+	return append(reply, byte(port>>8), byte(port))
+}
+
+// dialFailureReply return the reply code telling the client why a direct
+// dial failed, a general failure if the reason is unknown
+func dialFailureReply(err error) byte {
+	cause := err
+	if opErr, ok := cause.(*net.OpError); ok {
+		cause = opErr.Err
+	}
+	if sysErr, ok := cause.(*os.SyscallError); ok {
+		cause = sysErr.Err
+	}
+	switch cause {
+	case syscall.ECONNREFUSED:
+		return repConnectionRefused
+	case syscall.ENETUNREACH:
+		return repNetworkUnreachable
+	case syscall.EHOSTUNREACH:
+		return repHostUnreachable
+	}
+	if _, ok := cause.(*net.DNSError); ok {
+		return repHostUnreachable
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return repTTLExpired
+	}
+	return repGeneralFailure
+}
+
+func (s *Service) getRequest(conn net.Conn) (cmd byte, rawaddr []byte, host string, err error) {
 	const (
 		idVer   = 0
 		idCmd   = 1
@@ -191,29 +1507,27 @@ func (s *Service) getRequest(conn net.Conn) (rawaddr []byte, host string, err er
 		idDmLen = 4 // domain address length index
 		idDm0   = 5 // domain address start index
 
-		typeIPv4 = 1 // type is ipv4 address
-		typeDm   = 3 // type is domain address
-		typeIPv6 = 4 // type is ipv6 address
-
 		lenIPv4   = 3 + 1 + net.IPv4len + 2 // 3(ver+cmd+rsv) + 1addrType + ipv4 + 2port
 		lenIPv6   = 3 + 1 + net.IPv6len + 2 // 3(ver+cmd+rsv) + 1addrType + ipv6 + 2port
 		lenDmBase = 3 + 1 + 1 + 2           // 3 + 1addrType + 1addrLen + 2port, plus addrLen
 	)
 	// refer to getRequest in server.go for why set buffer size to 263
-	buf := make([]byte, 263)
+	buf := handshakeBufPool.Get().([]byte)[:263]
+	defer handshakeBufPool.Put(buf[:handshakeBufSize])
 	var n int
-	ss.SetReadTimeout(conn)
+	s.setHandshakeDeadline(conn)
 	// read till we get possible domain length field
 	if n, err = io.ReadAtLeast(conn, buf, idDmLen+1); err != nil {
 		return
 	}
 	// check version and cmd
 	if buf[idVer] != socksVer5 {
-		err = errVer
+		err = ErrVer
 		return
 	}
-	if buf[idCmd] != socksCmdConnect {
-		err = errCmd
+	cmd = buf[idCmd]
+	if !s.commandEnabled(cmd) {
+		err = ErrCmd
 		return
 	}
 
@@ -224,9 +1538,18 @@ func (s *Service) getRequest(conn net.Conn) (rawaddr []byte, host string, err er
 	case typeIPv6:
 		reqLen = lenIPv6
 	case typeDm:
+		if buf[idDmLen] == 0 {
+			err = ErrDomainLen
+			return
+		}
 		reqLen = int(buf[idDmLen]) + lenDmBase
 	default:
-		err = errAddrType
+		err = ErrAddrType
+		return
+	}
+	if reqLen > len(buf) {
+		// can't happen with a 255 bytes domain, but never slice out of buf
+		err = ErrDomainLen
 		return
 	}
 
@@ -237,64 +1560,177 @@ func (s *Service) getRequest(conn net.Conn) (rawaddr []byte, host string, err er
 			return
 		}
 	} else {
-		err = errReqExtraData
+		err = ErrReqExtraData
 		return
 	}
 
-	rawaddr = buf[idType:reqLen]
+	// buf goes back to the pool, rawaddr must not point into it
+	rawaddr = append([]byte(nil), buf[idType:reqLen]...)
 
-	if s.debug {
-		switch buf[idType] {
-		case typeIPv4:
-			host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
-		case typeIPv6:
-			host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
-		case typeDm:
-			host = string(buf[idDm0 : idDm0+buf[idDmLen]])
-		}
-		port := binary.BigEndian.Uint16(buf[reqLen-2 : reqLen])
-		host = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	switch buf[idType] {
+	case typeIPv4:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
+	case typeIPv6:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
+	case typeDm:
+		host = string(buf[idDm0 : idDm0+int(buf[idDmLen])])
 	}
+	port := binary.BigEndian.Uint16(buf[reqLen-2 : reqLen])
+	host = net.JoinHostPort(host, strconv.Itoa(int(port)))
 
 	return
 }
 
-// pipeThenClose copies data from src to dst, closes dst when done.
-func (s *Service) pipeThenClose(src, dst net.Conn, directionFlag int) {
+// pipeThenClose copies data from src to dst, closes dst when done. Bytes
+// written are added to the counter of t.
+func (s *Service) pipeThenClose(src, dst net.Conn, directionFlag int, t *tunnel) {
 	defer dst.Close()
-	buf := leakyBuf.Get()
-	defer leakyBuf.Put(buf)
+	if s.limiter == nil && canSplice(src, dst) {
+		s.spliceLoop(src, dst, directionFlag, t)
+		return
+	}
+	var buf []byte
+	var adaptive *adaptiveBuf
+	if s.adaptiveBuffers {
+		adaptive = newAdaptiveBuf()
+		defer adaptive.release()
+	} else {
+		buf = leakyBuf.Get()
+		defer leakyBuf.Put(buf)
+	}
 	for {
 		select {
 		case <-s.ch:
 			return
 		default:
 		}
-		src.SetReadDeadline(time.Now().Add(5e9))
+		if adaptive != nil {
+			buf = adaptive.buf
+		}
+		src.SetReadDeadline(s.now().Add(s.readTimeout))
 		n, err := src.Read(buf)
 		// read may return EOF with n > 0
 		// should always process n > 0 bytes before handling error
 		if n > 0 {
+			if directionFlag == directionInput && !t.firstByte {
+				s.reportFirstByte(t)
+			}
+			s.throttle(t, n)
+			s.setWriteDeadline(dst)
 			// Note: avoid overwrite err returned by Read.
-			if n, err := dst.Write(buf[0:n]); err != nil {
+			written, err := dst.Write(buf[0:n])
+			// a failed write may still have written part of the data
+			if written > 0 {
+				s.report(directionFlag, written, t.counter)
+			}
+			if err == nil && written < n {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
 				s.debug.Println("write:", err)
-				break
-			} else {
-				if s.trafficListener != nil {
-					switch directionFlag {
-					case directionOutput:
-						s.trafficListener.Sent(n)
-					case directionInput:
-						s.trafficListener.Received(n)
-					}
+				if isTimeout(err) {
+					// the peer is stuck, tear down the other direction too
+					src.Close()
 				}
+				break
+			}
+			if adaptive != nil && written == len(buf) {
+				adaptive.grow()
 			}
 		}
 		if err != nil {
 			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+				if adaptive != nil {
+					adaptive.shrink()
+				}
 				continue
 			}
 			break
 		}
 	}
 }
+
+// canSplice report whether data from src to dst can be relayed by the
+// kernel, which is only possible between two plain tcp connections
+func canSplice(src, dst net.Conn) bool {
+	_, srcOK := src.(*net.TCPConn)
+	_, dstOK := dst.(*net.TCPConn)
+	return srcOK && dstOK
+}
+
+// spliceLoop copies data from src to dst with io.CopyN, which uses splice(2)
+// on Linux. Copying a chunk at a time lets it report traffic.
+//
+// A failed splice may drop the data in flight, so the loop can't poll with a
+// read deadline like the buffered loop. Instead src is woken up when the
+// service stops, and any other timeout means dst is stuck.
+func (s *Service) spliceLoop(src, dst net.Conn, directionFlag int, t *tunnel) {
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-s.ch:
+			src.SetReadDeadline(s.now())
+		case <-done:
+		}
+	}()
+
+	src.SetReadDeadline(time.Time{})
+	for {
+		s.setWriteDeadline(dst)
+		n, err := io.CopyN(dst, src, spliceChunkSize)
+		if n > 0 {
+			s.report(directionFlag, int(n), t.counter)
+		}
+		if err != nil {
+			select {
+			case <-s.ch:
+				return
+			default:
+			}
+			if isTimeout(err) {
+				// the peer is stuck, tear down the other direction too
+				src.Close()
+			}
+			if err != io.EOF {
+				s.debug.Println("splice:", err)
+			}
+			return
+		}
+	}
+}
+
+// setWriteDeadline apply the write timeout to conn before a write
+func (s *Service) setWriteDeadline(conn net.Conn) {
+	if s.writeTimeout > 0 {
+		conn.SetWriteDeadline(s.now().Add(s.writeTimeout))
+	}
+}
+
+// isTimeout report whether err is a network timeout
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// reportFirstByte notify the latency listener of the time to first byte of
+// a proxied tunnel, it is only called from the input direction
+func (s *Service) reportFirstByte(t *tunnel) {
+	t.firstByte = true
+	if s.latencyListener != nil && t.server != "" {
+		s.latencyListener.FirstByte(t.server, s.now().Sub(t.established))
+	}
+}
+
+// report add n bytes to counter and notify the traffic listener
+func (s *Service) report(directionFlag, n int, counter *trafficCounter) {
+	counter.add(directionFlag, n)
+	if s.trafficListener != nil {
+		switch directionFlag {
+		case directionOutput:
+			s.trafficListener.Sent(n)
+		case directionInput:
+			s.trafficListener.Received(n)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDialIPsFallsBackToOtherFamily(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// nothing listens on the IPv6 loopback, the IPv4 family wins
+	dialer := &net.Dialer{Timeout: time.Second, FallbackDelay: time.Hour}
+	conn, err := dialIPs(dialer, []net.IP{net.IPv6loopback, net.IPv4(127, 0, 0, 1)}, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+// parseBoundAddr parse the BND.ADDR and BND.PORT fields of a socks reply
+func parseBoundAddr(t *testing.T, reply []byte) (net.IP, int) {
+	if len(reply) < 4 || reply[0] != socksVer5 || reply[2] != 0 {
+		t.Fatalf("malformed reply %v", reply)
+	}
+	var n int
+	switch reply[3] {
+	case typeIPv4:
+		n = net.IPv4len
+	case typeIPv6:
+		n = net.IPv6len
+	default:
+		t.Fatalf("address type %d in reply", reply[3])
+	}
+	if len(reply) != 4+n+2 {
+		t.Fatalf("reply of %d bytes for address type %d", len(reply), reply[3])
+	}
+	return net.IP(reply[4 : 4+n]), int(reply[4+n])<<8 | int(reply[5+n])
+}
+
+func TestSocksReplyBoundAddr(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		ip   net.IP
+		port int
+	}{
+		{nil, net.IPv4zero, 0},
+		{&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1080}, net.IPv4(10, 0, 0, 1), 1080},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, net.ParseIP("2001:db8::1"), 53},
+		{&net.TCPAddr{IP: net.IPv6unspecified}, net.IPv6unspecified, 0},
+	}
+	for _, test := range tests {
+		ip, port := parseBoundAddr(t, socksReply(repSucceeded, test.addr))
+		if !ip.Equal(test.ip) || port != test.port {
+			t.Errorf("socksReply(%v) bound %v:%d, want %v:%d", test.addr, ip, port, test.ip, test.port)
+		}
+	}
+}
+
+func TestUnspecifiedAddrMatchesFamily(t *testing.T) {
+	for _, network := range []string{"tcp4", "tcp6"} {
+		l, err := net.Listen(network, "localhost:0")
+		if err != nil {
+			t.Logf("%s: %v", network, err)
+			continue
+		}
+		conn, err := net.Dial(network, l.Addr().String())
+		if err != nil {
+			l.Close()
+			t.Fatal(err)
+		}
+		ip, _ := parseBoundAddr(t, socksReply(repSucceeded, unspecifiedAddr(conn)))
+		if !ip.IsUnspecified() || (ip.To4() != nil) != (network == "tcp4") {
+			t.Errorf("%s: bound address %v", network, ip)
+		}
+		conn.Close()
+		l.Close()
+	}
+}
+
+// socksConn return the server end of a connection the client wrote msg to
+// and then closed
+func socksConn(msg []byte) net.Conn {
+	client, conn := net.Pipe()
+	go func() {
+		client.Write(msg)
+		client.Close()
+	}()
+	return conn
+}
+
+func TestGetRequestDomainLength(t *testing.T) {
+	long := strings.Repeat("a", 255)
+	tests := []struct {
+		name string
+		msg  []byte
+		host string
+		err  error
+	}{
+		{"empty", []byte{socksVer5, socksCmdConnect, 0, typeDm, 0, 0, 80}, "", ErrDomainLen},
+		{"longest", append(append([]byte{socksVer5, socksCmdConnect, 0, typeDm, 255}, long...), 0, 80),
+			net.JoinHostPort(long, "80"), nil},
+		{"truncated", []byte{socksVer5, socksCmdConnect, 0, typeDm, 11, 'e', 'x', 'a'}, "", io.EOF},
+	}
+	s := NewService(&ServerCipher{server: "server.test:8388"})
+	for _, test := range tests {
+		conn := socksConn(test.msg)
+		_, _, host, err := s.getRequest(conn)
+		conn.Close()
+		if err != test.err || host != test.host {
+			t.Errorf("%s: host %q, error %v, want %q, %v", test.name, host, err, test.host, test.err)
+		}
+	}
+}
+
+func TestHandShakeNoAcceptableMethod(t *testing.T) {
+	s := NewService(&ServerCipher{server: "server.test:8388"})
+	client, conn := net.Pipe()
+	defer client.Close()
+	s.waitGroup.Add(1)
+	go s.handleConnection(conn)
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	// GSSAPI and username/password but no "no authentication required"
+	if _, err := client.Write([]byte{socksVer5, 2, 1, methodUserPass}); err != nil {
+		t.Fatal(err)
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(client, reply[:]); err != nil {
+		t.Fatal(err)
+	}
+	if reply != [2]byte{socksVer5, methodNoAcceptable} {
+		t.Fatalf("reply %v", reply)
+	}
+	if _, err := client.Read(reply[:]); err != io.EOF {
+		t.Fatalf("connection still open after the rejection: %v", err)
+	}
+}
+
+// shortWriteConn write only half of every buffer and report no error, like
+// a broken net.Conn
+type shortWriteConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *shortWriteConn) Write(b []byte) (int, error) {
+	c.writes++
+	return len(b) / 2, nil
+}
+
+func (c *shortWriteConn) Close() error { return nil }
+
+func TestPipeThenCloseShortWrite(t *testing.T) {
+	s := NewService(&ServerCipher{server: "server.test:8388"})
+	client, src := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("0123456789"))
+
+	remote, peer := net.Pipe()
+	defer peer.Close()
+	dst := &shortWriteConn{Conn: remote}
+	tun := s.newTunnel("example.com:80", s.routeCounter(RouteDirect))
+	done := make(chan bool)
+	go func() {
+		s.pipeThenClose(src, dst, directionOutput, tun)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the pipe went on after a short write")
+	}
+	if dst.writes != 1 {
+		t.Errorf("%d writes, want the pipe to stop at the short one", dst.writes)
+	}
+	if sent := tun.counter.stats().Sent; sent != 5 {
+		t.Errorf("counted %d bytes sent, want the 5 written", sent)
+	}
+}
+
+// replayConn read msg and discard what is written
+type replayConn struct {
+	net.Conn
+	msg *bytes.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error)         { return c.msg.Read(b) }
+func (c *replayConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func BenchmarkHandshake(b *testing.B) {
+	s := NewService(&ServerCipher{server: "server.test:8388"})
+	greeting := []byte{1, methodNoAuth}
+	request := []byte{socksVer5, socksCmdConnect, 0, typeDm, 11}
+	request = append(append(request, "example.com"...), 1, 187)
+	conn := &replayConn{msg: bytes.NewReader(nil)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		conn.msg.Reset(greeting)
+		if err := s.handShake(conn, socksVer5); err != nil {
+			b.Fatal(err)
+		}
+		conn.msg.Reset(request)
+		if _, _, _, err := s.getRequest(conn); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRequestErrorReplies(t *testing.T) {
+	tests := []struct {
+		request []byte
+		rep     byte
+	}{
+		{[]byte{socksVer5, socksCmdConnect, 0, 2, 0, 0, 0, 0, 0, 80}, repAddrTypeNotSupported},
+		{[]byte{socksVer5, socksCmdConnect, 0, typeDm, 0, 0, 80}, repGeneralFailure},
+	}
+	for _, test := range tests {
+		s := NewService(&ServerCipher{server: "server.test:8388"})
+		client, conn := net.Pipe()
+		s.waitGroup.Add(1)
+		go s.handleConnection(conn)
+
+		client.SetDeadline(time.Now().Add(time.Second))
+		client.Write([]byte{socksVer5, 1, methodNoAuth})
+		var reply [2]byte
+		if _, err := io.ReadFull(client, reply[:]); err != nil {
+			t.Fatal(err)
+		}
+		client.Write(test.request)
+		rep := make([]byte, 3+1+net.IPv4len+2)
+		if _, err := io.ReadFull(client, rep); err != nil {
+			t.Fatal(err)
+		}
+		if rep[1] != test.rep {
+			t.Errorf("request %v: reply %d, want %d", test.request, rep[1], test.rep)
+		}
+		client.Close()
+	}
+}
@@ -15,6 +15,7 @@ type ShadowsocksClient struct {
 	Running      bool
 	service      *Service
 	serverCipher *ServerCipher
+	config       *Config // loaded from configPath, nil for the settings of the window
 }
 
 // Run to start up local service
@@ -26,26 +27,47 @@ func (sc *ShadowsocksClient) Run() {
 
 		logger.Println("==RUN==...")
 
-		if err := sc.parseConfig(); err != nil {
+		service, listenAddr, err := sc.newService()
+		if err != nil {
+			logger.Println(err)
+			ch <- err
+			return
+		}
+		addr, err := net.ResolveTCPAddr("tcp", listenAddr)
+		if err != nil {
+			logger.Println(err)
+			service.Stop()
 			ch <- err
 			return
 		}
-
-		listenAddr := "127.0.0.1:1080"
-		addr, _ := net.ResolveTCPAddr("tcp", listenAddr)
 
 		listener, err := net.ListenTCP("tcp", addr)
 		if err != nil {
 			logger.Println(err)
+			service.Stop()
 			ch <- err
 			return
 		}
 		logger.Printf("Starting local socks5 server at %v", listener.Addr())
 
-		service := NewService(sc.serverCipher)
 		service.SetTrafficListener(sc)
+		service.SetConnCloseListener(sc)
+		if sc.config != nil {
+			if err := sc.serveConfig(service, listener.Addr().String()); err != nil {
+				logger.Println(err)
+				listener.Close()
+				service.Stop()
+				ch <- err
+				return
+			}
+			Watch(configPath, service)
+		}
 		sc.service = service
-		go service.Serve(listener)
+		go func() {
+			if err := service.Serve(listener); err != nil {
+				logger.Println(err)
+			}
+		}()
 		sc.Running = true
 		ch <- nil
 	}(ch)
@@ -96,16 +118,77 @@ func (sc *ShadowsocksClient) emitSignal(signal, data string) {
 	handler.Call("emitSignal", signal, data)
 }
 
+// newService return the service and the address of its listener, built from
+// the config file given with -c if any, else from the settings of the window
+func (sc *ShadowsocksClient) newService() (*Service, string, error) {
+	if configPath == "" {
+		if err := sc.parseConfig(); err != nil {
+			return nil, "", err
+		}
+		return NewService(sc.serverCipher), "127.0.0.1:1080", nil
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, "", err
+	}
+	service, err := NewServiceFromConfig(config)
+	if err != nil {
+		return nil, "", err
+	}
+	sc.config = config
+	return service, config.ListenAddr(), nil
+}
+
+// serveConfig start the listeners the config file asks for besides the socks
+// one at socksAddr, they close when the service stops
+func (sc *ShadowsocksClient) serveConfig(service *Service, socksAddr string) error {
+	if addr := sc.config.PACAddr(); addr != "" {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		logger.Printf("Serving the PAC file at %v", listener.Addr())
+		go func() {
+			if err := service.ServePAC(listener, socksAddr); err != nil {
+				logger.Println(err)
+			}
+		}()
+	}
+	if addr := sc.config.DNSAddr(); addr != "" {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return err
+		}
+		udp, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return err
+		}
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+		tcp, err := net.ListenTCP("tcp", tcpAddr)
+		if err != nil {
+			udp.Close()
+			return err
+		}
+		logger.Printf("Starting dns forwarder at %v", tcp.Addr())
+		go func() {
+			if err := service.ServeDNS(udp, tcp, sc.config.DNSUpstream); err != nil {
+				logger.Println(err)
+			}
+		}()
+	}
+	return nil
+}
+
 func (sc *ShadowsocksClient) parseConfig() error {
 	// if remote := net.ParseIP(fmt.Sprint(sc.Server)); remote == nil {
 	// 	return errors.New(fmt.Sprintf("%v is not a valid ip address", sc.Server))
 	// }
 	sc.Server = fmt.Sprintf("%v:%d", sc.Server, sc.ServerPort)
-	cipher, err := ss.NewCipher(sc.Method, sc.Password)
+	serverCipher, err := NewServerCipher(fmt.Sprint(sc.Server), sc.Method, sc.Password)
 	if err != nil {
 		return err
 	}
-	sc.serverCipher = &ServerCipher{fmt.Sprint(sc.Server), cipher}
+	sc.serverCipher = serverCipher
 
 	return nil
 }
@@ -120,6 +203,13 @@ func (sc *ShadowsocksClient) Received(n int) {
 	sc.emitSignal("received", fmt.Sprint(n))
 }
 
+// ConnClosed to log a summary of a finished tunnel
+func (sc *ShadowsocksClient) ConnClosed(summary ConnSummary) {
+	logger.Printf("closed %s via %s, duration %v, sent %d, received %d",
+		summary.Destination, summary.Server, summary.Duration,
+		summary.Sent, summary.Received)
+}
+
 // CheckConnectivity to check connectivity with https://www.google.com/generate_204
 func (sc *ShadowsocksClient) CheckConnectivity() {
 
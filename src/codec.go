@@ -0,0 +1,257 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// codecFlag is set in the address type of a request followed by the name of
+// the codec the client offers, for a server of this package to answer
+const codecFlag = 0x20
+
+// codecBufSize is the size of the chunks decompressed ahead of the reads
+const codecBufSize = 4096
+
+var errCodecClosed = errors.New("codec: use of closed connection")
+
+// Codec transform the data of a tunnel between the socks client and the
+// shadowsocks connection, e.g. to compress it. The client offers its codec
+// along with the request and applies it only if the server accepts it. Only
+// a ServerService with the same codec does, see ServerService.SetCodecs,
+// other servers refuse the request.
+type Codec interface {
+	Name() string
+	// Wrap return a connection transforming data written to and read from
+	// conn. Reads and writes of the wrapper must count plain bytes.
+	Wrap(conn net.Conn) net.Conn
+}
+
+// SetCodec set the codec offered to the servers for proxied tunnels, nil
+// means no transform
+func (s *Service) SetCodec(codec Codec) {
+	s.codec = codec
+}
+
+// connectTunnel connect to the server like connectServer, offering the codec
+// if set and applying it if the server accepts it
+func (s *Service) connectTunnel(rawaddr []byte, req PickRequest) (net.Conn, *ServerCipher, error) {
+	if s.codec == nil {
+		return s.connectServer(rawaddr, req)
+	}
+	remote, serverCipher, err := s.connectServer(offerCodec(rawaddr, s.codec), req)
+	if err != nil {
+		return nil, serverCipher, err
+	}
+	// servers which don't know the flag close the connection or hang
+	s.setHandshakeDeadline(remote)
+	var accepted [1]byte
+	if _, err := io.ReadFull(remote, accepted[:]); err != nil {
+		remote.Close()
+		return nil, serverCipher, err
+	}
+	remote.SetReadDeadline(time.Time{})
+	if accepted[0] == 0 {
+		s.debug.Printf("codec %s refused by %s\n", s.codec.Name(), serverCipher.server)
+		return remote, serverCipher, nil
+	}
+	return s.codec.Wrap(remote), serverCipher, nil
+}
+
+// offerCodec return rawaddr flagged and followed by the name of codec
+func offerCodec(rawaddr []byte, codec Codec) []byte {
+	name := codec.Name()
+	offer := make([]byte, 0, len(rawaddr)+1+len(name))
+	offer = append(offer, rawaddr[0]|codecFlag)
+	offer = append(offer, rawaddr[1:]...)
+	offer = append(offer, byte(len(name)))
+	return append(offer, name...)
+}
+
+// readCodecOffer read the name of the codec a client offers after its
+// request
+func readCodecOffer(r io.Reader) (string, error) {
+	var buf [256]byte
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return "", err
+	}
+	n := int(buf[0])
+	if _, err := io.ReadFull(r, buf[1:1+n]); err != nil {
+		return "", err
+	}
+	return string(buf[1 : 1+n]), nil
+}
+
+type noopCodec struct{}
+
+// NoopCodec return a codec which leaves data untouched
+func NoopCodec() Codec {
+	return noopCodec{}
+}
+
+func (noopCodec) Name() string                { return "none" }
+func (noopCodec) Wrap(conn net.Conn) net.Conn { return conn }
+
+type deflateCodec struct {
+	level int
+}
+
+// DeflateCodec return a codec compressing tunnels with deflate at level,
+// see compress/flate for the levels
+func DeflateCodec(level int) Codec {
+	return deflateCodec{level}
+}
+
+func (c deflateCodec) Name() string { return "deflate" }
+
+func (c deflateCodec) Wrap(conn net.Conn) net.Conn {
+	w, err := flate.NewWriter(conn, c.level)
+	if err != nil {
+		w, _ = flate.NewWriter(conn, flate.DefaultCompression)
+	}
+	return newCodecConn(conn, w, func(r io.Reader) (io.Reader, error) {
+		return flate.NewReader(r), nil
+	})
+}
+
+type gzipCodec struct {
+	level int
+}
+
+// GzipCodec return a codec compressing tunnels with gzip at level, see
+// compress/gzip for the levels
+func GzipCodec(level int) Codec {
+	return gzipCodec{level}
+}
+
+func (c gzipCodec) Name() string { return "gzip" }
+
+func (c gzipCodec) Wrap(conn net.Conn) net.Conn {
+	w, err := gzip.NewWriterLevel(conn, c.level)
+	if err != nil {
+		w = gzip.NewWriter(conn)
+	}
+	return newCodecConn(conn, w, func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	})
+}
+
+// flushWriter is a compressor which can flush what it holds
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// codecConn compress the writes to conn, flushing after every write so
+// interactive tunnels aren't held back by the compressor. Decompressors give
+// up after the first error, so reads are decompressed by a goroutine
+// reading conn without deadline, and the read deadline only bounds the wait
+// for its output.
+type codecConn struct {
+	net.Conn
+	w flushWriter
+
+	chunks  chan []byte
+	err     error // set before chunks is closed
+	pending []byte
+	done    chan struct{}
+	close   sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func newCodecConn(conn net.Conn, w flushWriter, newReader func(io.Reader) (io.Reader, error)) *codecConn {
+	c := &codecConn{
+		Conn:   conn,
+		w:      w,
+		chunks: make(chan []byte),
+		done:   make(chan struct{}),
+	}
+	conn.SetReadDeadline(time.Time{})
+	go c.decompress(newReader)
+	return c
+}
+
+// decompress feed chunks with the data read from conn until an error
+func (c *codecConn) decompress(newReader func(io.Reader) (io.Reader, error)) {
+	defer close(c.chunks)
+	r, err := newReader(c.Conn)
+	for err == nil {
+		buf := make([]byte, codecBufSize)
+		var n int
+		n, err = r.Read(buf)
+		if n > 0 {
+			select {
+			case c.chunks <- buf[:n]:
+			case <-c.done:
+				return
+			}
+		}
+	}
+	c.err = err
+}
+
+func (c *codecConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case chunk, ok := <-c.chunks:
+			if !ok {
+				return 0, c.err
+			}
+			c.pending = chunk
+		case <-timeout:
+			return 0, &net.OpError{Op: "read", Net: "tcp", Addr: c.RemoteAddr(), Err: os.ErrDeadlineExceeded}
+		case <-c.done:
+			return 0, errCodecClosed
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *codecConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+// SetDeadline set the deadline of the reads of the wrapper and of the
+// writes to conn
+func (c *codecConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline bound the wait for decompressed data, conn itself is read
+// without deadline
+func (c *codecConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *codecConn) Close() error {
+	c.close.Do(func() {
+		close(c.done)
+	})
+	return c.Conn.Close()
+}
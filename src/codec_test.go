@@ -0,0 +1,57 @@
+package main
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCodecSurvivesReadTimeouts(t *testing.T) {
+	for _, codec := range []Codec{DeflateCodec(flate.BestSpeed), GzipCodec(flate.BestSpeed)} {
+		a, b := net.Pipe()
+		ca, cb := codec.Wrap(a), codec.Wrap(b)
+		go func() {
+			cb.Write([]byte("before"))
+			time.Sleep(100 * time.Millisecond)
+			cb.Write([]byte("after the timeout"))
+		}()
+
+		buf := make([]byte, 64)
+		n, err := io.ReadAtLeast(ca, buf, len("before"))
+		if err != nil || string(buf[:n]) != "before" {
+			t.Fatalf("%s: read %q, %v", codec.Name(), buf[:n], err)
+		}
+		ca.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, err := ca.Read(buf); !isTimeout(err) {
+			t.Fatalf("%s: read %v, want a timeout", codec.Name(), err)
+		}
+		ca.SetReadDeadline(time.Now().Add(time.Second))
+		n, err = io.ReadAtLeast(ca, buf, len("after the timeout"))
+		if err != nil || string(buf[:n]) != "after the timeout" {
+			t.Fatalf("%s: read %q, %v after a timeout", codec.Name(), buf[:n], err)
+		}
+		ca.Close()
+		cb.Close()
+	}
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	echo := startEcho(t)
+	srv, err := NewServerService("aes-256-gcm", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SetCodecs(DeflateCodec(flate.BestSpeed))
+	server := startServer(t, srv)
+
+	for _, codec := range []Codec{DeflateCodec(flate.BestSpeed), GzipCodec(flate.BestSpeed)} {
+		s, socksAddr := startClient(t, server, "aes-256-gcm", "secret")
+		s.SetCodec(codec)
+		conn := socksConnect(t, socksAddr, echo)
+		// gzip is refused by the server, the tunnel is left untouched
+		echoRoundTrip(t, conn, "compressed if both ends agree")
+		conn.Close()
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Config is the json configuration of the client, in the format used by
+// the other shadowsocks clients. Servers listed in "servers" inherit method,
+// password and plugin from the top level when they leave them empty. The
+// gui-config.json format of shadowsocks-windows is read too.
+type Config struct {
+	Server       string            `json:"server"`
+	ServerPort   int               `json:"server_port"`
+	Method       string            `json:"method"`
+	Password     string            `json:"password"`
+	Plugin       string            `json:"plugin"`
+	PluginOpts   string            `json:"plugin_opts"`
+	Servers      []ServerConfig    `json:"servers"`
+	Chain        []ServerConfig    `json:"chain"` // hops to go through, in order, before the server
+	LocalAddress string            `json:"local_address"`
+	LocalPort    int               `json:"local_port"`
+	Timeout      int               `json:"timeout"`
+	PACPort      int               `json:"pac_port"`       // port serving the PAC file, none if zero
+	ACL          string            `json:"acl"`            // path of an acl file routing the destinations
+	GFWListURL   string            `json:"gfwlist_url"`    // gfwlist refreshed daily, routed after the acl
+	GeoIP        string            `json:"geoip"`          // path of a MaxMind country database
+	GeoIPDirect  []string          `json:"geoip_direct"`   // countries routed directly, like "CN"
+	BypassLAN    bool              `json:"bypass_lan"`     // connect the local network directly
+	Blocklist    string            `json:"blocklist"`      // path of the destinations refused
+	AllowClients []string          `json:"allow_clients"`  // networks the clients may connect from
+	DNSPort      int               `json:"dns_port"`       // port of the dns forwarder, none if zero
+	DNSUpstream  string            `json:"dns_upstream"`   // resolver the dns forwarder queries, 8.8.8.8:53 by default
+	DirectDNS    string            `json:"direct_dns"`     // DoH url or tls://host resolving the direct connections
+	DNSCacheSize int               `json:"dns_cache_size"` // entries of the dns cache, none if zero
+	FakeIP       string            `json:"fake_ip"`        // network of the fake addresses answered by the dns forwarder
+	Hosts        map[string]string `json:"hosts"`          // domains overridden with an address or a domain
+	Sniff        bool              `json:"sniff"`          // route and log the hosts sniffed from tls and http
+	DeferReply   bool              `json:"defer_reply"`    // reply to socks requests once the dial is done
+	RemoteDNS    bool              `json:"remote_dns"`     // turn requests for sniffed hosts back into domains
+	RateLimit    int               `json:"rate_limit"`     // bytes per second of all tunnels, both directions together, none if zero
+	MaxLifetime  int               `json:"max_lifetime"`   // seconds a tunnel may last, none if zero
+	MaxFailures  int               `json:"max_failures"`   // failed handshakes a minute refusing a client, none if zero
+
+	// gui-config.json lists the servers in configs, index is the one in
+	// use or -1 to balance among all of them
+	Configs      []ServerConfig `json:"configs"`
+	Index        int            `json:"index"`
+	GUILocalPort int            `json:"localPort"`
+	ShareOverLan bool           `json:"shareOverLan"`
+}
+
+// ServerConfig is one server entry of Config
+type ServerConfig struct {
+	Server     string `json:"server"`
+	ServerPort int    `json:"server_port"`
+	Method     string `json:"method"`
+	Password   string `json:"password"`
+	Plugin     string `json:"plugin"`
+	PluginOpts string `json:"plugin_opts"`
+	Remarks    string `json:"remarks"`
+	Weight     int    `json:"weight"` // share of connections, 1 when unset
+}
+
+// LoadConfig read a json config file
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	config.fromGUIConfig()
+	return config, nil
+}
+
+// fromGUIConfig move the fields of the gui-config.json format to their
+// equivalent
+func (c *Config) fromGUIConfig() {
+	if len(c.Servers) == 0 && len(c.Configs) > 0 {
+		if c.Index >= 0 && c.Index < len(c.Configs) {
+			c.Servers = c.Configs[c.Index : c.Index+1]
+		} else {
+			c.Servers = c.Configs
+		}
+	}
+	if c.LocalPort == 0 {
+		c.LocalPort = c.GUILocalPort
+	}
+	if c.LocalAddress == "" && c.ShareOverLan {
+		c.LocalAddress = "0.0.0.0"
+	}
+}
+
+// NewServiceFromConfig return a service for the servers of c, balanced with
+// round robin, reached through the hops of the chain
+func NewServiceFromConfig(c *Config) (*Service, error) {
+	servers, err := c.ServerCiphers()
+	if err != nil {
+		return nil, err
+	}
+	if c.RateLimit < 0 {
+		return nil, configError("", "rate_limit", fmt.Errorf("invalid limit %d", c.RateLimit))
+	}
+	if c.MaxLifetime < 0 {
+		return nil, configError("", "max_lifetime", fmt.Errorf("invalid limit %d", c.MaxLifetime))
+	}
+	if c.MaxFailures < 0 {
+		return nil, configError("", "max_failures", fmt.Errorf("invalid limit %d", c.MaxFailures))
+	}
+	if _, err := parseClientNetworks(c.AllowClients); err != nil {
+		return nil, configError("", "allow_clients", err)
+	}
+	hops, err := c.ChainCiphers()
+	if err != nil {
+		return nil, err
+	}
+	var acl *ACL
+	if c.ACL != "" {
+		if acl, err = LoadACL(c.ACL); err != nil {
+			return nil, err
+		}
+	}
+	var blocklist *Blocklist
+	if c.Blocklist != "" {
+		if blocklist, err = LoadBlocklist(c.Blocklist); err != nil {
+			return nil, err
+		}
+	}
+	var resolver Resolver
+	if c.DirectDNS != "" {
+		if resolver, err = NewSecureResolver(c.DirectDNS); err != nil {
+			return nil, configError("", "direct_dns", err)
+		}
+	}
+	var fakeIP *FakeIPPool
+	if c.FakeIP != "" {
+		if fakeIP, err = NewFakeIPPool(c.FakeIP); err != nil {
+			return nil, configError("", "fake_ip", err)
+		}
+	}
+	var hosts *Hosts
+	if len(c.Hosts) > 0 {
+		if hosts, err = NewHosts(c.Hosts); err != nil {
+			return nil, configError("", "hosts", err)
+		}
+	}
+	// opened last, nothing closes it if the config is rejected
+	var geoIP *GeoIP
+	if c.GeoIP != "" && len(c.GeoIPDirect) > 0 {
+		if geoIP, err = NewGeoIP(c.GeoIP, c.GeoIPDirect...); err != nil {
+			return nil, err
+		}
+	}
+	s := NewService(servers[0])
+	s.ReloadServers(servers)
+	// installed with a single server too, the reloads may add more
+	s.SetLoadBalancer(NewRoundRobinBalancer())
+	s.SetEagerReply(!c.DeferReply)
+	if timeout := c.HandshakeTimeout(); timeout > 0 {
+		s.SetHandshakeTimeout(timeout)
+	}
+	s.SetRateLimit(c.RateLimit)
+	s.SetMaxConnLifetime(time.Duration(c.MaxLifetime) * time.Second)
+	s.SetHandshakeFailureLimit(c.MaxFailures, time.Minute)
+	if len(hops) > 0 {
+		s.SetProxyDialer(NewChainDialer(hops...))
+	}
+	if acl != nil {
+		s.AddRouter(acl)
+	}
+	if c.GFWListURL != "" {
+		// everything goes through the servers until the list is fetched
+		gfwlist := &ACL{}
+		s.AddRouter(gfwlist)
+		s.UpdateGFWList(gfwlist, c.GFWListURL, gfwListInterval)
+	}
+	if geoIP != nil {
+		s.AddRouter(geoIP)
+	}
+	s.SetBypassLAN(c.BypassLAN)
+	s.SetRemoteDNS(c.RemoteDNS)
+	s.SetSniffing(c.Sniff)
+	if resolver != nil {
+		s.SetResolver(resolver)
+	}
+	if fakeIP != nil {
+		s.SetFakeIP(fakeIP)
+	}
+	if hosts != nil {
+		s.SetHosts(hosts)
+	}
+	if c.DNSCacheSize > 0 {
+		s.SetDNSCache(NewDNSCache(c.DNSCacheSize))
+	}
+	// validated above
+	s.SetAllowedClients(c.AllowClients...)
+	if blocklist != nil {
+		s.SetBlocklist(blocklist)
+	}
+	return s, nil
+}
+
+// ListenAddr return the address of the local socks listener
+func (c *Config) ListenAddr() string {
+	addr := c.LocalAddress
+	if addr == "" {
+		addr = "127.0.0.1"
+	}
+	port := c.LocalPort
+	if port == 0 {
+		port = 1080
+	}
+	return net.JoinHostPort(addr, strconv.Itoa(port))
+}
+
+// PACAddr return the address of the PAC file listener, empty if disabled.
+// It is on the address of the socks listener.
+func (c *Config) PACAddr() string {
+	if c.PACPort == 0 {
+		return ""
+	}
+	host, _, _ := net.SplitHostPort(c.ListenAddr())
+	return net.JoinHostPort(host, strconv.Itoa(c.PACPort))
+}
+
+// DNSAddr return the address of the dns forwarder, on udp and tcp, empty if
+// disabled. It is on the address of the socks listener.
+func (c *Config) DNSAddr() string {
+	if c.DNSPort == 0 {
+		return ""
+	}
+	host, _, _ := net.SplitHostPort(c.ListenAddr())
+	return net.JoinHostPort(host, strconv.Itoa(c.DNSPort))
+}
+
+// HandshakeTimeout return the configured timeout, zero if not set
+func (c *Config) HandshakeTimeout() time.Duration {
+	return time.Duration(c.Timeout) * time.Second
+}
+
+// ServerCiphers build the ciphers of all configured servers, the error tells
+// which field is invalid
+func (c *Config) ServerCiphers() ([]*ServerCipher, error) {
+	servers := c.Servers
+	if len(servers) == 0 {
+		servers = []ServerConfig{{Server: c.Server, ServerPort: c.ServerPort}}
+	}
+
+	list := make([]*ServerCipher, 0, len(servers))
+	for i, server := range servers {
+		field := fmt.Sprintf("servers[%d]", i)
+		if len(c.Servers) == 0 {
+			field = ""
+		}
+		serverCipher, err := c.serverCipher(field, server)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, serverCipher)
+	}
+	return list, nil
+}
+
+// ChainCiphers build the ciphers of the hops of the chain, in order
+func (c *Config) ChainCiphers() ([]*ServerCipher, error) {
+	list := make([]*ServerCipher, 0, len(c.Chain))
+	for i, server := range c.Chain {
+		serverCipher, err := c.serverCipher(fmt.Sprintf("chain[%d]", i), server)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, serverCipher)
+	}
+	return list, nil
+}
+
+// serverCipher build the cipher of server, field prefixes the errors
+func (c *Config) serverCipher(field string, server ServerConfig) (*ServerCipher, error) {
+	method, password := server.Method, server.Password
+	if method == "" {
+		method = c.Method
+	}
+	if password == "" {
+		password = c.Password
+	}
+	plugin, pluginOpts := server.Plugin, server.PluginOpts
+	if plugin == "" {
+		plugin, pluginOpts = c.Plugin, c.PluginOpts
+	}
+
+	if server.Server == "" {
+		return nil, configError(field, "server", errors.New("missing"))
+	}
+	if server.ServerPort <= 0 || server.ServerPort > 65535 {
+		return nil, configError(field, "server_port", fmt.Errorf("invalid port %d", server.ServerPort))
+	}
+	if password == "" {
+		return nil, configError(field, "password", errors.New("missing"))
+	}
+	if server.Weight < 0 {
+		return nil, configError(field, "weight", fmt.Errorf("invalid weight %d", server.Weight))
+	}
+	addr := net.JoinHostPort(server.Server, strconv.Itoa(server.ServerPort))
+	serverCipher, err := NewServerCipher(addr, method, password)
+	if err != nil {
+		return nil, configError(field, "method", err)
+	}
+	serverCipher.SetWeight(server.Weight)
+	serverCipher.SetPlugin(plugin, pluginOpts)
+	return serverCipher, nil
+}
+
+func configError(prefix, field string, err error) error {
+	if prefix != "" {
+		field = prefix + "." + field
+	}
+	return fmt.Errorf("config %s: %v", field, err)
+}
+
+// Watch reload the servers of service from the config file at path, and the
+// GeoIP databases, every time the process receives SIGHUP, until the
+// service stops
+func Watch(path string, s *Service) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sig)
+		for {
+			select {
+			case <-s.ch:
+				return
+			case <-sig:
+			}
+			logger.Println("reloading", path)
+			config, err := LoadConfig(path)
+			if err != nil {
+				logger.Println(err)
+				continue
+			}
+			servers, err := config.ServerCiphers()
+			if err != nil {
+				logger.Println(err)
+				continue
+			}
+			if err := s.ReloadServers(servers); err != nil {
+				logger.Println(err)
+			}
+			for _, r := range s.routers {
+				if geoIP, ok := r.(*GeoIP); ok {
+					if err := geoIP.Reload(); err != nil {
+						logger.Println(err)
+					}
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfigLimits(t *testing.T) {
+	c := &Config{
+		Server:      "server.test",
+		ServerPort:  8388,
+		Method:      "aes-256-gcm",
+		Password:    "secret",
+		RateLimit:   1 << 20,
+		MaxLifetime: 3600,
+		MaxFailures: 5,
+	}
+	s, err := NewServiceFromConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.limiter == nil || s.limiter.rate != 1<<20 {
+		t.Error("rate limit not applied")
+	}
+	if s.maxConnLifetime != time.Hour {
+		t.Errorf("max lifetime %v, want 1h", s.maxConnLifetime)
+	}
+	if s.guard == nil || s.guard.limit != 5 {
+		t.Error("handshake failure limit not applied")
+	}
+
+	c.RateLimit = -1
+	if _, err := NewServiceFromConfig(c); err == nil {
+		t.Error("negative rate limit accepted")
+	}
+	c.RateLimit = 0
+	c.AllowClients = []string{"not an address"}
+	if _, err := NewServiceFromConfig(c); err == nil {
+		t.Error("invalid allow_clients accepted")
+	}
+}
+
+func TestConfigReloadBalances(t *testing.T) {
+	c := &Config{Server: "one.test", ServerPort: 8388, Method: "aes-256-gcm", Password: "secret"}
+	s, err := NewServiceFromConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	c.Servers = []ServerConfig{{Server: "one.test", ServerPort: 8388}, {Server: "two.test", ServerPort: 8388}}
+	servers, err := c.ServerCiphers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ReloadServers(servers)
+	picked := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		picked[s.pickServer(PickRequest{}).server] = true
+	}
+	if len(picked) != 2 {
+		t.Errorf("picked %v after reloading two servers, want both", picked)
+	}
+}
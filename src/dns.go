@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+const (
+	// defaultDNSUpstream is the resolver of the dns forwarder if none is set
+	defaultDNSUpstream = "8.8.8.8:53"
+	// dnsQueryTimeout is how long a query forwarded to upstream may take
+	dnsQueryTimeout = 5 * time.Second
+	// dnsMaxMessage is the size of the largest dns message
+	dnsMaxMessage = 65535
+	// dnsIdleTimeout is how long a tcp dns client may wait between queries
+	dnsIdleTimeout = 10 * time.Second
+)
+
+// ServeDNS serve a dns forwarder on the udp conn and on the tcp listener,
+// either may be nil, sending the queries to upstream, the ip:port of a
+// resolver, through the servers whatever the routers decide. Queries always
+// go over tcp in the tunnel, the servers may not relay udp. Queries on both
+// get the answers of the hosts, of the fake ip pool and of the dns cache
+// first. It returns when the service stops, or with the error which broke
+// one of them.
+func (s *Service) ServeDNS(udp *net.UDPConn, tcp *net.TCPListener, upstream string) error {
+	if upstream == "" {
+		upstream = defaultDNSUpstream
+	}
+	rawaddr, err := ss.RawAddr(upstream)
+	if err != nil {
+		if udp != nil {
+			udp.Close()
+		}
+		if tcp != nil {
+			tcp.Close()
+		}
+		return err
+	}
+
+	errs := make(chan error, 2)
+	n := 0
+	if tcp != nil {
+		n++
+		go func() {
+			errs <- s.serve(func(conn net.Conn) {
+				defer s.waitGroup.Done()
+				defer conn.Close()
+				s.forwardDNSStream(conn, rawaddr, upstream)
+			}, []*net.TCPListener{tcp})
+		}()
+	}
+	if udp != nil {
+		n++
+		go func() {
+			errs <- s.serveDNSPackets(udp, rawaddr, upstream)
+		}()
+	}
+	var first error
+	for ; n > 0; n-- {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// forwardDNSStream answer the queries of the tcp dns client conn in turn,
+// like the udp ones, see exchangeDNS
+func (s *Service) forwardDNSStream(conn net.Conn, rawaddr []byte, upstream string) {
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-s.ch:
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	remoteAddr := conn.RemoteAddr().String()
+	var size [2]byte
+	for {
+		conn.SetReadDeadline(s.now().Add(dnsIdleTimeout))
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			s.debug.Println("dns:", err)
+			return
+		}
+		answer, err := s.exchangeDNS(query, rawaddr, remoteAddr, upstream)
+		if err != nil {
+			s.debug.Println("dns:", err)
+			return
+		}
+		msg := make([]byte, 2+len(answer))
+		binary.BigEndian.PutUint16(msg, uint16(len(answer)))
+		copy(msg[2:], answer)
+		s.setWriteDeadline(conn)
+		if _, err := conn.Write(msg); err != nil {
+			s.debug.Println("dns:", err)
+			return
+		}
+	}
+}
+
+// serveDNSPackets answer the queries received on conn until the service
+// stops
+func (s *Service) serveDNSPackets(conn *net.UDPConn, rawaddr []byte, upstream string) error {
+	s.waitGroup.Add(1)
+	defer s.waitGroup.Done()
+	s.serveOnce.Do(s.waitGroup.Done)
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-s.closing:
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	buf := make([]byte, dnsMaxMessage)
+	for {
+		n, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.closing:
+				return nil
+			default:
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return err
+		}
+		if !s.clientAllowed(client) {
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		s.waitGroup.Add(1)
+		go func() {
+			defer s.waitGroup.Done()
+			answer, err := s.exchangeDNS(query, rawaddr, client.String(), upstream)
+			if err != nil {
+				s.debug.Println("dns:", err)
+				return
+			}
+			if _, err := conn.WriteToUDP(answer, client); err != nil {
+				s.debug.Println("dns:", err)
+			}
+		}()
+	}
+}
+
+// exchangeDNS send query to upstream over tcp through the servers and
+// return the answer, or the one of the hosts, of the fake ip pool or of the
+// dns cache
+func (s *Service) exchangeDNS(query, rawaddr []byte, client, upstream string) ([]byte, error) {
+	if s.hosts != nil {
+		if answer := s.hosts.answer(query); answer != nil {
+			return answer, nil
+		}
+	}
+	if s.fakeIP != nil {
+		if answer := s.fakeIP.answer(query); answer != nil {
+			return answer, nil
+		}
+	}
+	if s.dnsCache != nil {
+		if answer := s.dnsCache.answer(query, s.now()); answer != nil {
+			return answer, nil
+		}
+	}
+	remote, serverCipher, err := s.connectTunnel(rawaddr, PickRequest{Client: client, Destination: upstream})
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Close()
+	remote.SetDeadline(s.now().Add(dnsQueryTimeout))
+
+	answer, err := exchangeDNSStream(remote, query)
+	if err != nil {
+		return nil, err
+	}
+	counter := s.serverCounter(serverCipher.server)
+	s.report(directionOutput, 2+len(query), counter)
+	s.report(directionInput, 2+len(answer), counter)
+	if s.dnsCache != nil {
+		s.dnsCache.storeAnswer(query, answer, s.now())
+	}
+	return answer, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNSStreamAnswersHosts(t *testing.T) {
+	// the server is unreachable, the answer must come from the hosts
+	serverCipher, err := NewServerCipher("127.0.0.1:1", "aes-256-gcm", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(serverCipher)
+	hosts, err := NewHosts(map[string]string{"router.lan": "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetHosts(hosts)
+	l := listenTCP(t)
+	go s.ServeDNS(nil, l, "")
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 2; i++ {
+		query, _ := newDNSQuery("router.lan", dnsmessage.TypeA)
+		answer, err := exchangeDNSStream(conn, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(answer); err != nil {
+			t.Fatal(err)
+		}
+		if len(msg.Answers) != 1 {
+			t.Fatalf("query %d: %d answers, want 1", i, len(msg.Answers))
+		}
+		if a, ok := msg.Answers[0].Body.(*dnsmessage.AResource); !ok || net.IP(a.A[:]).String() != "192.168.1.1" {
+			t.Errorf("query %d: answer %v", i, msg.Answers[0].Body)
+		}
+	}
+}
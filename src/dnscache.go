@@ -0,0 +1,231 @@
+package main
+
+import (
+	"container/list"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// dnsDefaultTTL is how long the addresses of a resolver telling no ttl,
+	// like the system one, are cached
+	dnsDefaultTTL = time.Minute
+	// dnsNegativeTTL is how long missing hosts are cached when the answer
+	// tells no ttl
+	dnsNegativeTTL = 30 * time.Second
+)
+
+// ttlResolver is a Resolver which knows how long its addresses are valid
+type ttlResolver interface {
+	lookupIPTTL(host string) ([]net.IP, time.Duration, error)
+}
+
+// DNSCache remember the addresses of the hosts connected directly and of the
+// servers, and the answers of the dns forwarder, as long as their ttl. Hosts
+// which don't exist are remembered too. Once full the least recently used
+// entries are evicted.
+type DNSCache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // most recently used first
+}
+
+type dnsCacheEntry struct {
+	key     string
+	ips     []net.IP
+	err     error
+	answer  []byte // answer of the dns forwarder
+	stored  time.Time
+	expires time.Time
+}
+
+// NewDNSCache return a cache of at most size entries
+func NewDNSCache(size int) *DNSCache {
+	return &DNSCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// SetDNSCache set the cache of the resolutions of the service, nil disables
+// it. A cache may be shared by several services.
+func (s *Service) SetDNSCache(c *DNSCache) {
+	s.dnsCache = c
+}
+
+// Flush forget all the entries, e.g. after the network changed
+func (c *DNSCache) Flush() {
+	c.mu.Lock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.mu.Unlock()
+}
+
+// get return the entry of key if it is still valid
+func (c *DNSCache) get(key string, now time.Time) *dnsCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := elem.Value.(*dnsCacheEntry)
+	if !now.Before(e.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return e
+}
+
+// put add e, evicting the least recently used entries if full
+func (c *DNSCache) put(e *dnsCacheEntry) {
+	if c.size <= 0 || !e.stored.Before(e.expires) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[e.key]; ok {
+		c.lru.Remove(elem)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsCacheEntry).key)
+	}
+}
+
+// lookupIP return the addresses of host, resolved with r if not cached
+func (c *DNSCache) lookupIP(r Resolver, host string, now time.Time) ([]net.IP, error) {
+	key := "ip " + strings.ToLower(host)
+	if e := c.get(key, now); e != nil {
+		return e.ips, e.err
+	}
+	var ips []net.IP
+	var err error
+	ttl := dnsDefaultTTL
+	if tr, ok := r.(ttlResolver); ok {
+		ips, ttl, err = tr.lookupIPTTL(host)
+	} else {
+		ips, err = r.LookupIP(host)
+	}
+	if err != nil {
+		// only missing hosts are cached, not failures to resolve
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			c.put(&dnsCacheEntry{key: key, err: err, stored: now, expires: now.Add(dnsNegativeTTL)})
+		}
+		return nil, err
+	}
+	c.put(&dnsCacheEntry{key: key, ips: ips, stored: now, expires: now.Add(ttl)})
+	return ips, nil
+}
+
+// queryKey return the key of the answer to query, false if it isn't a
+// valid query
+func queryKey(query []byte) (string, bool) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return "", false
+	}
+	q, err := p.Question()
+	if err != nil {
+		return "", false
+	}
+	return "msg " + strings.ToLower(q.Name.String()) + " " + q.Type.String() + " " + q.Class.String(), true
+}
+
+// answer return the cached answer to query, with the id of query and the
+// ttls reduced by the time it was cached, nil if there is none
+func (c *DNSCache) answer(query []byte, now time.Time) []byte {
+	key, ok := queryKey(query)
+	if !ok {
+		return nil
+	}
+	e := c.get(key, now)
+	if e == nil {
+		return nil
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(e.answer); err != nil {
+		return nil
+	}
+	msg.ID = uint16(query[0])<<8 | uint16(query[1])
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, rrs := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range rrs {
+			if rrs[i].Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if rrs[i].Header.TTL > elapsed {
+				rrs[i].Header.TTL -= elapsed
+			} else {
+				rrs[i].Header.TTL = 0
+			}
+		}
+	}
+	answer, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return answer
+}
+
+// storeAnswer cache the answer to query of the dns forwarder, answers for
+// missing names or records are cached as long as the SOA record tells
+func (c *DNSCache) storeAnswer(query, answer []byte, now time.Time) {
+	key, ok := queryKey(query)
+	if !ok {
+		return
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(answer); err != nil || msg.Truncated {
+		return
+	}
+	var ttl time.Duration
+	switch {
+	case msg.RCode == dnsmessage.RCodeSuccess && len(msg.Answers) > 0:
+		ttl = answerTTL(&msg)
+	case msg.RCode == dnsmessage.RCodeSuccess || msg.RCode == dnsmessage.RCodeNameError:
+		ttl = negativeTTL(&msg)
+	default:
+		// failures of the resolver are not cached
+		return
+	}
+	stored := append([]byte(nil), answer...)
+	c.put(&dnsCacheEntry{key: key, answer: stored, stored: now, expires: now.Add(ttl)})
+}
+
+// answerTTL return the lowest ttl of the answers of msg
+func answerTTL(msg *dnsmessage.Message) time.Duration {
+	var ttl uint32
+	for i, rr := range msg.Answers {
+		if i == 0 || rr.Header.TTL < ttl {
+			ttl = rr.Header.TTL
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// negativeTTL return how long the missing name or records of msg may be
+// cached (RFC 2308)
+func negativeTTL(msg *dnsmessage.Message) time.Duration {
+	for _, rr := range msg.Authorities {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			ttl := rr.Header.TTL
+			if soa.MinTTL < ttl {
+				ttl = soa.MinTTL
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return dnsNegativeTTL
+}
@@ -0,0 +1,66 @@
+package main
+
+import "time"
+
+// eventsBufferSize is how many events are kept for a slow consumer before
+// new ones are dropped
+const eventsBufferSize = 256
+
+// ConnEventType is the kind of a ConnEvent
+type ConnEventType int
+
+// Types of ConnEvent
+const (
+	ConnAccepted ConnEventType = iota
+	ConnEstablished
+	ConnDialFailed
+	ConnClosed
+	ConnHandshakeFailed
+)
+
+func (t ConnEventType) String() string {
+	switch t {
+	case ConnAccepted:
+		return "accepted"
+	case ConnEstablished:
+		return "established"
+	case ConnDialFailed:
+		return "dial failed"
+	case ConnClosed:
+		return "closed"
+	case ConnHandshakeFailed:
+		return "handshake failed"
+	}
+	return "unknown"
+}
+
+// ConnEvent is a step in the life of a socks connection. Destination and
+// Server are empty until known, Sent and Received are set on close. Err of
+// a failed handshake is a *SocksError when the client broke the protocol.
+// Every failed dial to a server is published, a connection whose last dial
+// failed has no ConnEstablished event.
+type ConnEvent struct {
+	Type        ConnEventType
+	Time        time.Time
+	Remote      string
+	Destination string
+	Server      string
+	Sent        uint64
+	Received    uint64
+	Err         error
+}
+
+// Events return the feed of connection events. Events are dropped when the
+// channel is full, so a slow consumer never blocks the proxy.
+func (s *Service) Events() <-chan ConnEvent {
+	return s.events
+}
+
+// publish send event to the feed without blocking
+func (s *Service) publish(event ConnEvent) {
+	event.Time = s.now()
+	select {
+	case s.events <- event:
+	default:
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeIPTTL is the ttl of the fake addresses, short since they are recycled
+const fakeIPTTL = 1
+
+// FakeIPPool hand out addresses of a reserved IPv4 network in the answers
+// of the dns forwarder, one per domain, so the connections intercepted on
+// their way to them are tunneled to the domain. Once all the addresses are
+// used the oldest ones are recycled.
+type FakeIPPool struct {
+	base uint32
+	size uint32
+
+	mu       sync.Mutex
+	next     uint32 // offset of the next address handed out
+	byDomain map[string]uint32
+	byOffset map[uint32]string
+}
+
+// NewFakeIPPool return a pool of the addresses of cidr, an IPv4 network
+// nothing uses like "198.18.0.0/15"
+func NewFakeIPPool(cidr string) (*FakeIPPool, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip4 := ipnet.IP.To4()
+	ones, bits := ipnet.Mask.Size()
+	if ip4 == nil || bits != 32 || ones > 30 {
+		return nil, fmt.Errorf("fake ip network %s is not an IPv4 network of 4 addresses or more", cidr)
+	}
+	return &FakeIPPool{
+		base: binary.BigEndian.Uint32(ip4),
+		// without the network and broadcast addresses
+		size:     1<<uint(bits-ones) - 2,
+		byDomain: make(map[string]uint32),
+		byOffset: make(map[uint32]string),
+	}, nil
+}
+
+// SetFakeIP set the pool of fake addresses answered by the dns forwarder,
+// and translated back to domains for the connections of ServeRedir,
+// ServeTProxy and ServeTUN and the datagrams of ServeTProxyUDP and ServeTUN,
+// nil disables it. Queries for IPv6 addresses get an empty answer so the
+// clients use the fake ones.
+func (s *Service) SetFakeIP(pool *FakeIPPool) {
+	s.fakeIP = pool
+}
+
+// ip return the fake address of domain, handing out one if it has none
+func (p *FakeIPPool) ip(domain string) net.IP {
+	domain = normalizeDomain(domain)
+	p.mu.Lock()
+	offset, ok := p.byDomain[domain]
+	if !ok {
+		offset = p.next + 1
+		p.next = (p.next + 1) % p.size
+		if old, ok := p.byOffset[offset]; ok {
+			delete(p.byDomain, old)
+		}
+		p.byDomain[domain] = offset
+		p.byOffset[offset] = domain
+	}
+	p.mu.Unlock()
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, p.base+offset)
+	return ip
+}
+
+// domain return the domain ip was handed out for, ok is false if ip is not
+// in the pool. The domain is empty if ip is in the pool but was recycled or
+// handed out before a restart.
+func (p *FakeIPPool) domain(ip net.IP) (domain string, ok bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return "", false
+	}
+	offset := binary.BigEndian.Uint32(ip4) - p.base
+	if offset > p.size {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.byOffset[offset], true
+}
+
+// answer return the answer to query with a fake address, nil if query is
+// not for the addresses of a domain and goes to the resolver
+func (p *FakeIPPool) answer(query []byte) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	q := msg.Questions[0]
+	if q.Class != dnsmessage.ClassINET || q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
+		return nil
+	}
+	msg.Response = true
+	msg.RecursionAvailable = true
+	msg.Additionals = nil
+	if q.Type == dnsmessage.TypeA {
+		var a dnsmessage.AResource
+		copy(a.A[:], p.ip(q.Name.String()))
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: fakeIPTTL},
+			Body:   &a,
+		}}
+	}
+	answer, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return answer
+}
+
+// transparentAddr return the request for the intercepted connection to
+// ip and port, for its domain if ip is a fake address. ok is false when ip
+// is a fake address whose domain is unknown.
+func (s *Service) transparentAddr(ip net.IP, port int) (rawaddr []byte, addr string, ok bool) {
+	if s.fakeIP != nil {
+		if domain, fake := s.fakeIP.domain(ip); fake {
+			if domain == "" {
+				return nil, "", false
+			}
+			addr = net.JoinHostPort(domain, strconv.Itoa(port))
+			rawaddr, err := ss.RawAddr(addr)
+			if err != nil {
+				return nil, "", false
+			}
+			return rawaddr, addr, true
+		}
+	}
+	return ipRawAddr(ip, port), net.JoinHostPort(ip.String(), strconv.Itoa(port)), true
+}
+
+// transparentReplyAddr return the address the datagrams from addr come from
+// for a transparent client, the fake address of the domain if addr is a
+// domain
+func (s *Service) transparentReplyAddr(addr string) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.fakeIP == nil || net.ParseIP(host) != nil {
+		return net.ResolveUDPAddr("udp", addr)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: s.fakeIP.ip(host), Port: port}, nil
+}
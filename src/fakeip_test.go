@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestFakeIPPoolBounds(t *testing.T) {
+	p, err := NewFakeIPPool("198.18.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := p.ip("a.test"), p.ip("b.test")
+	if !first.Equal(net.IPv4(198, 18, 0, 1)) || !second.Equal(net.IPv4(198, 18, 0, 2)) {
+		t.Fatalf("handed out %v and %v", first, second)
+	}
+	if domain, ok := p.domain(second); !ok || domain != "a.test" && domain != "b.test" {
+		t.Errorf("domain of %v: %q, %v", second, domain, ok)
+	}
+	if _, ok := p.domain(net.IPv4(198, 18, 0, 3)); ok {
+		t.Error("the broadcast address is in the pool")
+	}
+	if _, ok := p.domain(net.IPv4(198, 18, 0, 4)); ok {
+		t.Error("an address past the network is in the pool")
+	}
+}
+
+func TestFakeIPAnswerAndTranslation(t *testing.T) {
+	p, err := NewFakeIPPool("198.18.0.0/15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, _ := newDNSQuery("Example.com", dnsmessage.TypeA)
+	var msg dnsmessage.Message
+	if err := msg.Unpack(p.answer(query)); err != nil {
+		t.Fatal(err)
+	}
+	a, ok := msg.Answers[0].Body.(*dnsmessage.AResource)
+	if len(msg.Answers) != 1 || !ok {
+		t.Fatalf("answers %v", msg.Answers)
+	}
+	fake := net.IP(a.A[:])
+	query, _ = newDNSQuery("example.com", dnsmessage.TypeAAAA)
+	if err := msg.Unpack(p.answer(query)); err != nil || len(msg.Answers) != 0 {
+		t.Errorf("AAAA answers %v, %v, want none", msg.Answers, err)
+	}
+
+	s := NewService(&ServerCipher{server: "server.test:8388"})
+	s.SetFakeIP(p)
+	if _, addr, ok := s.transparentAddr(fake, 443); !ok || addr != "example.com:443" {
+		t.Errorf("%v translated to %q, %v", fake, addr, ok)
+	}
+	if _, _, ok := s.transparentAddr(net.IPv4(198, 18, 0, 200), 443); ok {
+		t.Error("an address never handed out translated")
+	}
+	if _, addr, ok := s.transparentAddr(net.IPv4(10, 0, 0, 1), 443); !ok || addr != "10.0.0.1:443" {
+		t.Errorf("10.0.0.1 translated to %q, %v", addr, ok)
+	}
+	if from, err := s.transparentReplyAddr("example.com:443"); err != nil || !from.IP.Equal(fake) {
+		t.Errorf("replies of example.com from %v, %v, want %v", from, err, fake)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// directFallback track the failed dials to the servers, to connect directly
+// while they look unreachable
+type directFallback struct {
+	failures     int
+	window       time.Duration
+	destinations *destinationSet // nil for all of them
+
+	mu     sync.Mutex
+	failed []time.Time
+}
+
+// SetDirectFallback set that once failures dials to the servers failed
+// within window, new requests connect directly, until the failures are
+// older than window and the servers are tried again. Only the destinations
+// matching one of rules fall back, entries like the ones of a Blocklist, or
+// all of them without rules. Zero failures disables the fallback.
+func (s *Service) SetDirectFallback(failures int, window time.Duration, rules ...string) error {
+	if failures <= 0 {
+		s.fallback = nil
+		return nil
+	}
+	f := &directFallback{failures: failures, window: window}
+	if len(rules) > 0 {
+		destinations, err := newDestinationSet(rules...)
+		if err != nil {
+			return err
+		}
+		f.destinations = destinations
+	}
+	s.fallback = f
+	return nil
+}
+
+// active report whether addr should connect directly now
+func (f *directFallback) active(addr string, now time.Time) bool {
+	if f.destinations != nil {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return false
+		}
+		port, _ := strconv.Atoi(portStr)
+		if !f.destinations.match(host, port) {
+			return false
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expire(now)
+	return len(f.failed) >= f.failures
+}
+
+// dialed record the outcome of a dial to the servers
+func (f *directFallback) dialed(err error, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		f.failed = f.failed[:0]
+		return
+	}
+	f.expire(now)
+	f.failed = append(f.failed, now)
+}
+
+// expire forget the failures older than the window, f.mu must be held
+func (f *directFallback) expire(now time.Time) {
+	i := 0
+	for i < len(f.failed) && now.Sub(f.failed[i]) > f.window {
+		i++
+	}
+	f.failed = f.failed[i:]
+}
@@ -0,0 +1,25 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// tcpFastOpenConnect is TCP_FASTOPEN_CONNECT, available since Linux 4.11.
+// With it connect(2) returns at once and the first write goes in the SYN.
+const tcpFastOpenConnect = 30
+
+// fastOpenControl enable TCP Fast Open on a socket before connecting. The
+// dial fails if the kernel rejects the option.
+func fastOpenControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return os.NewSyscallError("setsockopt", err)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "syscall"
+
+// fastOpenControl is nil where TCP Fast Open is not supported, so the server
+// is dialed normally.
+var fastOpenControl func(network, address string, c syscall.RawConn) error
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoIPResolveTimeout is how long resolving a domain to find its country
+// may take, the request goes through the servers if it takes longer
+const geoIPResolveTimeout = 2 * time.Second
+
+// GeoIP route directly the destinations located in some countries, looked
+// up in a MaxMind database like GeoLite2-Country. Domains are resolved
+// locally to find their country.
+type GeoIP struct {
+	path      string
+	countries map[string]bool
+
+	mu sync.RWMutex
+	db *maxminddb.Reader
+}
+
+// geoIPRecord is the part of a database record used
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// NewGeoIP open the database at path and return a router sending the
+// destinations in countries, ISO codes like "CN", directly
+func NewGeoIP(path string, countries ...string) (*GeoIP, error) {
+	g := &GeoIP{path: path, countries: make(map[string]bool)}
+	for _, c := range countries {
+		g.countries[strings.ToUpper(c)] = true
+	}
+	if err := g.Reload(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Reload open the database again, after it was updated. The database in
+// use is kept if the new one can't be opened.
+func (g *GeoIP) Reload() error {
+	db, err := maxminddb.Open(g.path)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	old := g.db
+	g.db = db
+	g.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (g *GeoIP) Route(host string, port int) (Route, bool) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), geoIPResolveTimeout)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil || len(addrs) == 0 {
+			return RouteProxy, false
+		}
+		ip = addrs[0].IP
+	}
+
+	var record geoIPRecord
+	g.mu.RLock()
+	err := g.db.Lookup(ip, &record)
+	g.mu.RUnlock()
+	if err != nil || !g.countries[record.Country.ISOCode] {
+		return RouteProxy, false
+	}
+	return RouteDirect, true
+}
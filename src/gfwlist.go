@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// gfwListInterval is how often the gfwlist of a config is refreshed
+const gfwListInterval = 24 * time.Hour
+
+// ParseGFWList read a base64 encoded gfwlist, in the adblock format of
+// AutoProxy, as an acl: the domains it lists go through the servers, its
+// exceptions and everything else directly. Regular expressions and keyword
+// rules can't be told apart from paths by the host alone, they are skipped.
+func ParseGFWList(r io.Reader) (*ACL, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.Join(bytes.Fields(data), nil)
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(decoded, data)
+	if err != nil {
+		return nil, fmt.Errorf("gfwlist: %v", err)
+	}
+
+	acl := &ACL{hasDefault: true, defaultTo: RouteDirect, lists: make(map[Route]*ruleList)}
+	scanner := bufio.NewScanner(bytes.NewReader(decoded[:n]))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		route := RouteProxy
+		if strings.HasPrefix(line, "@@") {
+			route = RouteDirect
+			line = line[2:]
+		}
+		if host := gfwListHost(line); host != "" {
+			acl.list(route).add(host)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// gfwListHost return the host of a gfwlist rule, empty for the rules which
+// are not about a host
+func gfwListHost(rule string) string {
+	switch {
+	case strings.HasPrefix(rule, "/"):
+		return "" // regular expression
+	case strings.HasPrefix(rule, "||"):
+		rule = rule[2:]
+	case strings.HasPrefix(rule, "|"):
+		u, err := url.Parse(rule[1:])
+		if err != nil {
+			return ""
+		}
+		rule = u.Host
+	}
+	if i := strings.IndexAny(rule, "/^:"); i >= 0 {
+		rule = rule[:i]
+	}
+	rule = strings.TrimPrefix(rule, ".")
+	if rule == "" || strings.ContainsAny(rule, "*%") || !strings.Contains(rule, ".") {
+		return ""
+	}
+	return rule
+}
+
+// UpdateGFWList fetch the gfwlist at url now and every interval until the
+// service stops, replacing the rules of acl which should be one of its
+// routers. A failed refresh keeps the rules in use.
+func (s *Service) UpdateGFWList(acl *ACL, url string, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if list, err := fetchGFWList(url); err != nil {
+				s.logger.Printf("gfwlist %s: %v", url, err)
+			} else {
+				acl.replace(list)
+				s.debug.Println("gfwlist updated from", url)
+			}
+			select {
+			case <-s.ch:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func fetchGFWList(url string) (*ACL, error) {
+	client := &http.Client{Timeout: subscriptionTimeout}
+	res, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return ParseGFWList(res.Body)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestParseGFWList(t *testing.T) {
+	list := `[AutoProxy 0.2.9]
+! comment
+||blocked.test
+|http://plain.test/path
+.dotted.test
+@@||allowed.blocked.test
+/^https?:\/\/regexp\.test/
+keyword
+`
+	encoded := base64.StdEncoding.EncodeToString([]byte(list))
+	// lists are wrapped at 64 columns
+	acl, err := ParseGFWList(strings.NewReader(encoded[:64] + "\n" + encoded[64:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host  string
+		route Route
+	}{
+		{"blocked.test", RouteProxy},
+		{"www.blocked.test", RouteProxy},
+		{"plain.test", RouteProxy},
+		{"a.dotted.test", RouteProxy},
+		{"allowed.blocked.test", RouteDirect},
+		{"regexp.test", RouteDirect},
+		{"keyword", RouteDirect},
+	}
+	for _, tt := range tests {
+		if route, ok := acl.Route(tt.host, 443); !ok || route != tt.route {
+			t.Errorf("%s: route %v, %v, want %v", tt.host, route, ok, tt.route)
+		}
+	}
+
+	if _, err := ParseGFWList(strings.NewReader("not base64!")); err == nil {
+		t.Error("invalid base64 accepted")
+	}
+}
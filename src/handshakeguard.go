@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// handshakeGuardMaxIPs is how many client ips are tracked before expired
+// entries are pruned
+const handshakeGuardMaxIPs = 4096
+
+// HandshakeStats count the handshakes which failed. Aborted ones were
+// dropped or timed out by the client, invalid ones broke the protocol.
+type HandshakeStats struct {
+	Aborted uint64
+	Invalid uint64
+}
+
+type handshakeCounter struct {
+	aborted uint64
+	invalid uint64
+}
+
+// handshakeGuard refuse clients which failed too many handshakes within a
+// window, like port scanners churning through connections
+type handshakeGuard struct {
+	mu       sync.Mutex
+	limit    int
+	window   time.Duration
+	failures map[string]*ipFailures
+}
+
+type ipFailures struct {
+	count int
+	since time.Time
+}
+
+// SetHandshakeFailureLimit refuse connections from a client ip, before the
+// handshake, once it failed limit handshakes within window. Handshakes which
+// time out are not counted, so slow clients aren't taken for scanners. Zero
+// disables the limit.
+func (s *Service) SetHandshakeFailureLimit(limit int, window time.Duration) {
+	s.guard = nil
+	if limit > 0 && window > 0 {
+		s.guard = &handshakeGuard{
+			limit:    limit,
+			window:   window,
+			failures: make(map[string]*ipFailures),
+		}
+	}
+}
+
+// HandshakeStats return the number of failed handshakes
+func (s *Service) HandshakeStats() HandshakeStats {
+	return HandshakeStats{
+		Aborted: atomic.LoadUint64(&s.handshakes.aborted),
+		Invalid: atomic.LoadUint64(&s.handshakes.invalid),
+	}
+}
+
+// allowClient report whether a connection from addr may go on
+func (s *Service) allowClient(addr net.Addr) bool {
+	if s.guard == nil {
+		return true
+	}
+	return s.guard.allow(clientIP(addr), s.now())
+}
+
+// handshakeFailed count a failed handshake of the client at addr
+func (s *Service) handshakeFailed(addr net.Addr, err error) {
+	if _, ok := err.(*SocksError); ok {
+		atomic.AddUint64(&s.handshakes.invalid, 1)
+	} else {
+		atomic.AddUint64(&s.handshakes.aborted, 1)
+	}
+	if s.guard != nil && !isTimeout(err) {
+		s.guard.fail(clientIP(addr), s.now())
+	}
+}
+
+func clientIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func (g *handshakeGuard) allow(ip string, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, ok := g.failures[ip]
+	if !ok {
+		return true
+	}
+	if now.Sub(f.since) > g.window {
+		delete(g.failures, ip)
+		return true
+	}
+	return f.count < g.limit
+}
+
+func (g *handshakeGuard) fail(ip string, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, ok := g.failures[ip]
+	if !ok || now.Sub(f.since) > g.window {
+		if len(g.failures) >= handshakeGuardMaxIPs {
+			g.prune(now)
+		}
+		g.failures[ip] = &ipFailures{1, now}
+		return
+	}
+	f.count++
+}
+
+// prune forget the clients whose window expired
+func (g *handshakeGuard) prune(now time.Time) {
+	for ip, f := range g.failures {
+		if now.Sub(f.since) > g.window {
+			delete(g.failures, ip)
+		}
+	}
+}
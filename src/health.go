@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	// healthMaxAge is how long a health record is trusted by the health
+	// handler before the server is probed again
+	healthMaxAge       = 30 * time.Second
+	healthProbeTimeout = 3 * time.Second
+)
+
+// ServerHealth is the last known state of a server
+type ServerHealth struct {
+	Server    string        `json:"server"`
+	Reachable bool          `json:"reachable"`
+	Latency   time.Duration `json:"latency"`
+	Error     string        `json:"error,omitempty"`
+	Checked   time.Time     `json:"checked"`
+	Failures  uint64        `json:"failures"` // failed dials and probes
+}
+
+// recordHealth update the state of server after a dial or a probe
+func (s *Service) recordHealth(server string, latency time.Duration, err error) {
+	health := &ServerHealth{
+		Server:    server,
+		Reachable: err == nil,
+		Latency:   latency,
+		Checked:   s.now(),
+	}
+	if err != nil {
+		health.Error = err.Error()
+		health.Failures++
+	}
+	s.healthMu.Lock()
+	last, ok := s.health[server]
+	if ok {
+		health.Failures += last.Failures
+	}
+	s.health[server] = health
+	sink := s.healthSink
+	s.healthMu.Unlock()
+
+	if sink != nil && (!ok || last.Reachable != health.Reachable) {
+		go sink(s.HealthSnapshot())
+	}
+}
+
+// HealthSnapshot is the health of servers as seen by a service, shared with
+// other instances pointed at the same servers
+type HealthSnapshot struct {
+	Servers []ServerHealth `json:"servers"`
+}
+
+// SetHealthSink set a function called with a snapshot every time a server
+// goes up or down, to share it with peers over any transport
+func (s *Service) SetHealthSink(sink func(HealthSnapshot)) {
+	s.healthMu.Lock()
+	s.healthSink = sink
+	s.healthMu.Unlock()
+}
+
+// HealthSnapshot return the health records of all servers checked so far
+func (s *Service) HealthSnapshot() HealthSnapshot {
+	s.healthMu.RLock()
+	defer s.healthMu.RUnlock()
+	snapshot := HealthSnapshot{Servers: make([]ServerHealth, 0, len(s.health))}
+	for _, health := range s.health {
+		snapshot.Servers = append(snapshot.Servers, *health)
+	}
+	return snapshot
+}
+
+// ImportHealth merge the health records of a peer, records newer than the
+// local ones replace them so known bad servers are avoided without probing
+// them again. Failure counts stay local.
+func (s *Service) ImportHealth(snapshot HealthSnapshot) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	for _, health := range snapshot.Servers {
+		last, ok := s.health[health.Server]
+		if ok && !health.Checked.After(last.Checked) {
+			continue
+		}
+		imported := health
+		imported.Failures = 0
+		if ok {
+			imported.Failures = last.Failures
+		}
+		s.health[health.Server] = &imported
+	}
+}
+
+// isDown report whether server failed its last dial or probe, records older
+// than healthMaxAge are not trusted
+func (s *Service) isDown(server string) bool {
+	s.healthMu.RLock()
+	health, ok := s.health[server]
+	s.healthMu.RUnlock()
+	return ok && !health.Reachable && s.now().Sub(health.Checked) < healthMaxAge
+}
+
+// ServerHealth return the last known state of every configured server, the
+// servers never checked have a zero Checked time
+func (s *Service) ServerHealth() []ServerHealth {
+	s.serversMu.RLock()
+	servers := s.servers
+	s.serversMu.RUnlock()
+
+	s.healthMu.RLock()
+	defer s.healthMu.RUnlock()
+	list := make([]ServerHealth, len(servers))
+	for i, server := range servers {
+		if health, ok := s.health[server.server]; ok {
+			list[i] = *health
+		} else {
+			list[i] = ServerHealth{Server: server.server}
+		}
+	}
+	return list
+}
+
+// probeServer check that the server accepts connections, dialed like the
+// tunnels are: through its transport since QUIC and KCP servers only listen
+// on udp, through its plugin or through the proxy dialer
+func (s *Service) probeServer(sc *ServerCipher) {
+	start := s.now()
+	conn, err := s.dialConn(sc, healthProbeTimeout)
+	if err == nil {
+		conn.Close()
+	}
+	s.recordHealth(sc.server, s.now().Sub(start), err)
+}
+
+// SetHealthCheckInterval probe every server in the background every d
+// until the service stops, so their state and latency stay fresh even
+// without traffic. Zero stops probing.
+func (s *Service) SetHealthCheckInterval(d time.Duration) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	if s.healthStop != nil {
+		close(s.healthStop)
+		s.healthStop = nil
+	}
+	if d <= 0 {
+		return
+	}
+	stop := make(chan bool)
+	s.healthStop = stop
+	go s.probeLoop(d, stop)
+}
+
+// probeLoop probe the servers concurrently every d until stop or the
+// service is closed
+func (s *Service) probeLoop(d time.Duration, stop chan bool) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		s.serversMu.RLock()
+		servers := s.servers
+		s.serversMu.RUnlock()
+		for _, server := range servers {
+			go s.probeServer(server)
+		}
+		select {
+		case <-s.ch:
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeStale probe sc in the background unless a probe of it is running
+func (s *Service) probeStale(sc *ServerCipher) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	if s.probing[sc.server] {
+		return
+	}
+	s.probing[sc.server] = true
+	go func() {
+		s.probeServer(sc)
+		s.healthMu.Lock()
+		delete(s.probing, sc.server)
+		s.healthMu.Unlock()
+	}()
+}
+
+// serverLatency return the last measured latency of server
+func (s *Service) serverLatency(server string) (time.Duration, bool) {
+	s.healthMu.RLock()
+	defer s.healthMu.RUnlock()
+	health, ok := s.health[server]
+	if !ok || !health.Reachable {
+		return 0, false
+	}
+	return health.Latency, true
+}
+
+// serving report whether the service is accepting connections
+func (s *Service) serving() bool {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	select {
+	case <-s.closing:
+		return false
+	default:
+	}
+	return len(s.listeners) > 0
+}
+
+// HealthHandler return a http handler for liveness and readiness probes. It
+// responds 200 when the service is serving and at least one server is
+// reachable, 503 otherwise, with the state of each server as json. It answers
+// from the recorded state at once, servers without a recent record are probed
+// in the background for the next requests.
+func (s *Service) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serversMu.RLock()
+		servers := s.servers
+		s.serversMu.RUnlock()
+		for _, sc := range servers {
+			s.healthMu.RLock()
+			health, ok := s.health[sc.server]
+			s.healthMu.RUnlock()
+			if !ok || s.now().Sub(health.Checked) > healthMaxAge {
+				s.probeStale(sc)
+			}
+		}
+
+		status := struct {
+			Serving bool           `json:"serving"`
+			Servers []ServerHealth `json:"servers"`
+		}{s.serving(), s.ServerHealth()}
+
+		code := http.StatusServiceUnavailable
+		if status.Serving {
+			for _, health := range status.Servers {
+				if health.Reachable {
+					code = http.StatusOK
+					break
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(status)
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// blockedTransport is a transport whose dials hang until released
+type blockedTransport chan struct{}
+
+func (t blockedTransport) Dial(server string) (net.Conn, error) {
+	<-t
+	return nil, errors.New("unreachable")
+}
+
+func TestHealthHandlerDoesNotWaitForProbes(t *testing.T) {
+	sc := &ServerCipher{server: "server.test:8388"}
+	transport := make(blockedTransport)
+	defer close(transport)
+	sc.SetTransport(transport)
+	s := NewService(sc)
+
+	handler := s.HealthHandler()
+	done := make(chan int, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		done <- w.Code
+	}()
+	select {
+	case code := <-done:
+		if code != http.StatusServiceUnavailable {
+			t.Fatalf("status %d for a service without a reachable server", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the health handler waited for a hanging probe")
+	}
+}
+
+// clockTransport is a transport whose dials take d on the fake clock
+type clockTransport struct {
+	clock *time.Time
+	d     time.Duration
+}
+
+func (t clockTransport) Dial(server string) (net.Conn, error) {
+	*t.clock = t.clock.Add(t.d)
+	return nil, errors.New("unreachable")
+}
+
+func TestLatencyMeasuredWithClock(t *testing.T) {
+	clock := time.Unix(0, 0)
+	sc := &ServerCipher{server: "server.test:8388"}
+	sc.SetTransport(clockTransport{&clock, 42 * time.Millisecond})
+	s := NewService(sc)
+	s.setClock(func() time.Time { return clock })
+
+	s.probeServer(sc)
+	if health := s.health[sc.server]; health.Latency != 42*time.Millisecond || !health.Checked.Equal(clock) {
+		t.Fatalf("probe recorded %v at %v", health.Latency, health.Checked)
+	}
+	if _, _, err := s.connectServer([]byte{typeIPv4, 127, 0, 0, 1, 0, 80}, PickRequest{}); err == nil {
+		t.Fatal("dial through a failing transport succeeded")
+	}
+	if health := s.health[sc.server]; health.Latency != 42*time.Millisecond || health.Failures != 2 {
+		t.Fatalf("dial recorded %v after %d failures", health.Latency, health.Failures)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// hostsMaxDepth is how many domains overriding each other are followed
+	hostsMaxDepth = 8
+	// hostsTTL is the ttl of the addresses answered for the overrides
+	hostsTTL = 60
+)
+
+// Hosts override domains with an address or another domain, like
+// /etc/hosts. Domains match exactly, not their subdomains.
+type Hosts struct {
+	entries map[string]string
+}
+
+// NewHosts return the overrides of entries, domains mapped to an address or
+// a domain
+func NewHosts(entries map[string]string) (*Hosts, error) {
+	h := &Hosts{entries: make(map[string]string)}
+	for domain, target := range entries {
+		if err := h.add(domain, target); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// LoadHosts read a hosts file, lines with an address or a domain followed by
+// the domains it overrides, lines starting with # are comments
+func LoadHosts(path string) (*Hosts, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h, _ := NewHosts(nil)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("%s:%d: no domain for %s", path, n, fields[0])
+		}
+		for _, domain := range fields[1:] {
+			if err := h.add(domain, fields[0]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *Hosts) add(domain, target string) error {
+	domain = normalizeDomain(domain)
+	if domain == "" || net.ParseIP(domain) != nil {
+		return fmt.Errorf("invalid domain %q", domain)
+	}
+	if target == "" {
+		return fmt.Errorf("no override for %s", domain)
+	}
+	if net.ParseIP(target) == nil {
+		target = normalizeDomain(target)
+	}
+	h.entries[domain] = target
+	return nil
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// lookup return the override of host, following the domains overridden in
+// turn, ok is false if it has none
+func (h *Hosts) lookup(host string) (target string, ok bool) {
+	target = host
+	for i := 0; i < hostsMaxDepth; i++ {
+		next, found := h.entries[normalizeDomain(target)]
+		if !found {
+			break
+		}
+		target, ok = next, true
+	}
+	return target, ok
+}
+
+// SetHosts set the overrides of the destination domains, applied before
+// routing, resolving or dialing them, and of the hosts of the servers. The
+// dns forwarder answers the domains overridden with an address. Nil removes
+// them.
+func (s *Service) SetHosts(h *Hosts) {
+	s.hosts = h
+}
+
+// overrideHost return addr and rawaddr with their host replaced by its
+// override, as is without override
+func (s *Service) overrideHost(rawaddr []byte, addr string) ([]byte, string) {
+	if s.hosts == nil {
+		return rawaddr, addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return rawaddr, addr
+	}
+	target, ok := s.hosts.lookup(host)
+	if !ok {
+		return rawaddr, addr
+	}
+	overridden := net.JoinHostPort(target, port)
+	s.debug.Printf("%s overridden by %s\n", addr, overridden)
+	if ip := net.ParseIP(target); ip != nil {
+		p, _ := strconv.Atoi(port)
+		return ipRawAddr(ip, p), overridden
+	}
+	overriddenRaw, err := ss.RawAddr(overridden)
+	if err != nil {
+		return rawaddr, addr
+	}
+	return overriddenRaw, overridden
+}
+
+// answer return the answer to query with the address overriding its
+// domain, nil if it has none
+func (h *Hosts) answer(query []byte) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	q := msg.Questions[0]
+	if q.Class != dnsmessage.ClassINET || q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
+		return nil
+	}
+	target, ok := h.lookup(q.Name.String())
+	ip := net.ParseIP(target)
+	if !ok || ip == nil {
+		return nil
+	}
+	msg.Response = true
+	msg.RecursionAvailable = true
+	msg.Additionals = nil
+	header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: hostsTTL}
+	if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+		var a dnsmessage.AResource
+		copy(a.A[:], ip4)
+		msg.Answers = []dnsmessage.Resource{{Header: header, Body: &a}}
+	} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+		var aaaa dnsmessage.AAAAResource
+		copy(aaaa.AAAA[:], ip)
+		msg.Answers = []dnsmessage.Resource{{Header: header, Body: &aaaa}}
+	}
+	answer, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return answer
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// httpMethodInitials are the first letters of the http request methods, used
+// to tell an http request from a socks greeting
+const httpMethodInitials = "CDGHOPT"
+
+// bufferedConn is a connection whose first bytes were read ahead into r
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// ServeAuto to serve a listener accepting both socks and http CONNECT
+// clients, telling them apart by the first byte they send. Connections
+// starting with anything else are closed.
+func (s *Service) ServeAuto(listener *net.TCPListener) error {
+	return s.serve(s.handleAutoConnection, []*net.TCPListener{listener})
+}
+
+// handleAutoConnection peek the first byte of conn and pass it on to the
+// socks or http handler
+func (s *Service) handleAutoConnection(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	s.setHandshakeDeadline(conn)
+	first, err := r.Peek(1)
+	if err != nil {
+		s.debug.Println("peek first byte:", err)
+		conn.Close()
+		s.waitGroup.Done()
+		return
+	}
+	conn = &bufferedConn{conn, r}
+	switch {
+	case first[0] == socksVer5 || first[0] == socksVer4:
+		s.handleConnection(conn)
+	case strings.IndexByte(httpMethodInitials, first[0]) >= 0:
+		s.handleHTTPConnection(conn)
+	default:
+		s.debug.Printf("unknown protocol from %s, first byte %#x\n", conn.RemoteAddr(), first[0])
+		conn.Close()
+		s.waitGroup.Done()
+	}
+}
+
+// handleHTTPConnection tunnel an http CONNECT request like a socks connect
+// request, or forward a plain http request to its origin
+func (s *Service) handleHTTPConnection(conn net.Conn) {
+	defer s.waitGroup.Done()
+	defer func() {
+		conn.Close()
+	}()
+
+	if !s.allowClient(conn.RemoteAddr()) {
+		s.debug.Println("too many failed handshakes from", conn.RemoteAddr())
+		return
+	}
+	remoteAddr := conn.RemoteAddr().String()
+	s.publish(ConnEvent{Type: ConnAccepted, Remote: remoteAddr})
+
+	r := bufio.NewReader(conn)
+	s.setHandshakeDeadline(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		s.debug.Println("error reading http request:", err)
+		s.handshakeFailed(conn.RemoteAddr(), err)
+		s.publish(ConnEvent{Type: ConnHandshakeFailed, Remote: remoteAddr, Err: err})
+		return
+	}
+	if s.username != "" {
+		if !s.checkProxyAuth(req) {
+			s.debug.Println("http proxy authentication failed from", remoteAddr)
+			s.handshakeFailed(conn.RemoteAddr(), ErrAuthFailed)
+			s.publish(ConnEvent{Type: ConnHandshakeFailed, Remote: remoteAddr, Err: ErrAuthFailed})
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n" +
+				"Proxy-Authenticate: Basic realm=\"shadowsocks\"\r\nConnection: close\r\n\r\n"))
+			return
+		}
+	}
+	if req.Method != http.MethodConnect {
+		s.forwardHTTP(conn, r, req)
+		return
+	}
+	addr := req.URL.Host
+	rawaddr, err := ss.RawAddr(addr)
+	if err != nil {
+		s.debug.Println("http connect:", err)
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
+		return
+	}
+	if r.Buffered() > 0 {
+		// the client didn't wait for the reply
+		conn = &bufferedConn{conn, r}
+	}
+	s.tunnelRequest(conn, rawaddr, addr, func(rep byte) error {
+		status := "HTTP/1.1 200 Connection established\r\n\r\n"
+		if rep != repSucceeded {
+			status = "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n"
+		}
+		_, err := conn.Write([]byte(status))
+		return err
+	})
+}
+
+// hopHeaders are the headers meant for the proxy, not sent to the origin
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// forwardHTTP relay a plain http proxy request with an absolute uri to its
+// origin. The request line is rewritten to origin form, then the body and
+// the response are relayed as is. The connection serves a single request.
+func (s *Service) forwardHTTP(conn net.Conn, r *bufio.Reader, req *http.Request) {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		s.debug.Println("http proxy request without absolute uri:", req.Method, req.RequestURI)
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
+		return
+	}
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	rawaddr, err := ss.RawAddr(addr)
+	if err != nil {
+		s.debug.Println("http proxy:", err)
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
+		return
+	}
+
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	head := &bytes.Buffer{}
+	fmt.Fprintf(head, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	if len(req.TransferEncoding) > 0 {
+		// ReadRequest moves it out of the header, the body is still chunked
+		fmt.Fprintf(head, "Transfer-Encoding: %s\r\n", strings.Join(req.TransferEncoding, ", "))
+	}
+	req.Header.Write(head)
+	head.WriteString("Connection: close\r\n\r\n")
+
+	// the origin reads the rewritten head, then the body still buffered or
+	// unread on conn
+	client := &bufferedConn{conn, io.MultiReader(head, r)}
+	s.tunnelRequest(client, rawaddr, addr, func(rep byte) error {
+		if rep != repSucceeded {
+			_, err := conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n"))
+			return err
+		}
+		return nil
+	})
+}
+
+// checkProxyAuth report whether req carries the configured credentials in
+// its Proxy-Authorization header
+func (s *Service) checkProxyAuth(req *http.Request) bool {
+	// BasicAuth parses the Authorization header, which has the same form
+	auth := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+	username, password, ok := auth.BasicAuth()
+	return ok && s.checkCredentials(username, password)
+}
+
+// ServeHTTPProxy to serve a listener of http proxy clients, tunneling their
+// CONNECT requests and forwarding plain requests through the servers. It may
+// run alongside Serve, both listeners are closed by Stop.
+func (s *Service) ServeHTTPProxy(listener *net.TCPListener) error {
+	return s.serve(s.handleHTTPConnection, []*net.TCPListener{listener})
+}
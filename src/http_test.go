@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startHTTPProxy serve an http proxy to the server at address until the
+// test ends and return its address
+func startHTTPProxy(t *testing.T, server string) string {
+	s, _ := startClient(t, server, "aes-256-gcm", "secret")
+	l := listenTCP(t)
+	go s.ServeHTTPProxy(l)
+	return l.Addr().String()
+}
+
+func TestHTTPProxyForward(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.RequestURI, r.Header.Get("Proxy-Connection"))
+	}))
+	defer origin.Close()
+	srv, err := NewServerService("aes-256-gcm", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := startHTTPProxy(t, startServer(t, srv))
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET %s/path?q=1 HTTP/1.1\r\nHost: %s\r\nProxy-Connection: keep-alive\r\n\r\n",
+		origin.URL, origin.Listener.Addr())
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != "/path?q=1 " {
+		t.Errorf("%s %q, want the origin form and no proxy header", res.Status, body)
+	}
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	echo := startEcho(t)
+	srv, err := NewServerService("aes-256-gcm", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := startHTTPProxy(t, startServer(t, srv))
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo, echo)
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %s", res.Status)
+	}
+	echoRoundTrip(t, &bufferedConn{conn, r}, "through the http proxy")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// KCPConfig tune the KCP transport, see DefaultKCPConfig
+type KCPConfig struct {
+	// DataShards and ParityShards set the forward error correction, a group
+	// of DataShards packets survives the loss of ParityShards of them. Zero
+	// parity shards disables it.
+	DataShards   int
+	ParityShards int
+	// SendWindow and ReceiveWindow are the windows in packets
+	SendWindow    int
+	ReceiveWindow int
+	MTU           int
+	// NoDelay retransmits faster at the cost of bandwidth
+	NoDelay bool
+}
+
+// DefaultKCPConfig return the settings of the KCP transport which suit most
+// lossy links
+func DefaultKCPConfig() KCPConfig {
+	return KCPConfig{
+		DataShards:    10,
+		ParityShards:  3,
+		SendWindow:    128,
+		ReceiveWindow: 512,
+		MTU:           1350,
+		NoDelay:       true,
+	}
+}
+
+// kcpTransport carry each stream to a server on its own KCP session over
+// udp, which keeps its throughput on high latency and lossy paths
+type kcpTransport struct {
+	config KCPConfig
+}
+
+// NewKCPTransport return a KCP transport with config. The packets are not
+// encrypted by KCP, the shadowsocks stream is.
+func NewKCPTransport(config KCPConfig) Transport {
+	return &kcpTransport{config: config}
+}
+
+func (t *kcpTransport) Dial(server string) (net.Conn, error) {
+	c := t.config
+	dataShards, parityShards := c.DataShards, c.ParityShards
+	if parityShards <= 0 {
+		dataShards, parityShards = 0, 0
+	}
+	session, err := kcp.DialWithOptions(server, nil, dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	session.SetStreamMode(true)
+	session.SetWriteDelay(false)
+	session.SetACKNoDelay(true)
+	if c.NoDelay {
+		session.SetNoDelay(1, 20, 2, 1)
+	} else {
+		session.SetNoDelay(0, 40, 0, 0)
+	}
+	if c.SendWindow > 0 && c.ReceiveWindow > 0 {
+		session.SetWindowSize(c.SendWindow, c.ReceiveWindow)
+	}
+	if c.MTU > 0 {
+		session.SetMtu(c.MTU)
+	}
+	return session, nil
+}
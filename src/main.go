@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -15,6 +16,10 @@ var (
 	logger = log.New(os.Stdout, "", log.LstdFlags|log.Lshortfile)
 	root   qml.Object
 	tool   = &Tool{}
+
+	// configPath is the json config file given with -c, it replaces the
+	// settings of the window when set
+	configPath string
 )
 
 func init() {
@@ -32,6 +37,8 @@ func init() {
 }
 
 func main() {
+	flag.StringVar(&configPath, "c", "", "path of a json config file, replacing the settings of the window")
+	flag.Parse()
 	logger.Println("==START==")
 
 	// try to recovery system status
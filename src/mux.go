@@ -0,0 +1,518 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// smux version 1 frames, a stream is opened by SYN, carries data in PSH
+// frames and is closed by FIN. NOP frames keep the session alive.
+const (
+	smuxVersion    = 1
+	smuxSYN        = 0
+	smuxFIN        = 1
+	smuxPSH        = 2
+	smuxNOP        = 3
+	smuxHeaderSize = 8
+	smuxMaxFrame   = 32768
+
+	// muxTarget is the address requested to the server for a mux session,
+	// the server must serve smux on it as ServerService does
+	muxTarget = "sp.mux.shadowsocks.arpa:444"
+
+	muxKeepAlive = 10 * time.Second
+	// muxKeepAliveTimeout is how long a session may receive nothing, the
+	// servers send NOP frames too, before it is considered dead
+	muxKeepAliveTimeout = 30 * time.Second
+	// muxReceiveBuffer is how much data a session buffers for its streams
+	// before it stops reading from the server
+	muxReceiveBuffer = 4 * 1024 * 1024
+)
+
+var (
+	errMuxClosed  = errors.New("mux session closed")
+	errMuxVersion = errors.New("mux: unsupported version")
+	errMuxTimeout = &muxTimeoutError{}
+)
+
+var muxRawAddr, _ = ss.RawAddr(muxTarget)
+
+type muxTimeoutError struct{}
+
+func (*muxTimeoutError) Error() string   { return "mux: i/o timeout" }
+func (*muxTimeoutError) Timeout() bool   { return true }
+func (*muxTimeoutError) Temporary() bool { return true }
+
+// SetMux set how many long-lived connections to each server carry the
+// tunnels as smux streams, instead of one connection per tunnel. Zero
+// disables multiplexing. The servers must serve smux sessions requested with
+// the address sp.mux.shadowsocks.arpa:444, which only ServerService does,
+// other servers fail to connect it and every tunnel with it.
+func (s *Service) SetMux(sessions int) {
+	if s.mux != nil {
+		s.mux.close()
+		s.mux = nil
+	}
+	if sessions > 0 {
+		s.mux = newMuxPool(sessions)
+	}
+}
+
+// muxPool keeps the mux sessions to every server and spreads the streams
+// among them
+type muxPool struct {
+	size     int
+	mu       sync.Mutex
+	sessions map[string][]*muxSession
+	dialing  map[string]int // sessions being dialed
+	closed   bool
+}
+
+func newMuxPool(size int) *muxPool {
+	return &muxPool{
+		size:     size,
+		sessions: make(map[string][]*muxSession),
+		dialing:  make(map[string]int),
+	}
+}
+
+// open a stream to the target rawaddr on one of the sessions to server,
+// dialing a new session with dial while there are fewer than the pool size
+func (p *muxPool) open(server string, rawaddr []byte, dial func() (net.Conn, error)) (net.Conn, error) {
+	session, err := p.session(server, dial)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.openStream()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(rawaddr); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// session return the least busy live session to server. The pool is not
+// locked while a new session is dialed, so a slow server doesn't hold up the
+// others.
+func (p *muxPool) session(server string, dial func() (net.Conn, error)) (*muxSession, error) {
+	p.mu.Lock()
+	var live []*muxSession
+	var best *muxSession
+	for _, session := range p.sessions[server] {
+		if session.isClosed() {
+			continue
+		}
+		live = append(live, session)
+		if best == nil || session.numStreams() < best.numStreams() {
+			best = session
+		}
+	}
+	p.sessions[server] = live
+	if best != nil && (best.numStreams() == 0 || len(live)+p.dialing[server] >= p.size) {
+		p.mu.Unlock()
+		return best, nil
+	}
+	p.dialing[server]++
+	p.mu.Unlock()
+
+	conn, err := dial()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing[server]--
+	if err != nil {
+		if best != nil && !best.isClosed() {
+			return best, nil
+		}
+		return nil, err
+	}
+	session := newMuxSession(conn)
+	if p.closed {
+		session.close()
+		return nil, errMuxClosed
+	}
+	p.sessions[server] = append(p.sessions[server], session)
+	return session, nil
+}
+
+// close all the sessions and their streams
+func (p *muxPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, sessions := range p.sessions {
+		for _, session := range sessions {
+			session.close()
+		}
+	}
+	p.sessions = make(map[string][]*muxSession)
+}
+
+// muxSession is a smux session on conn, on the client side or on the server
+// side, where it accepts the streams opened by the client
+type muxSession struct {
+	conn     net.Conn
+	writeMu  sync.Mutex
+	lastRecv int64 // unix nanoseconds of the last frame received, atomic
+
+	mu       sync.Mutex
+	streams  map[uint32]*muxStream
+	nextID   uint32
+	buffered int
+	drained  *sync.Cond
+
+	accept chan *muxStream // streams opened by the client, nil on clients
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func newMuxSession(conn net.Conn) *muxSession {
+	return startMuxSession(conn, nil)
+}
+
+// newMuxServerSession return the server side of a session, its streams are
+// received from accept
+func newMuxServerSession(conn net.Conn) *muxSession {
+	return startMuxSession(conn, make(chan *muxStream))
+}
+
+func startMuxSession(conn net.Conn, accept chan *muxStream) *muxSession {
+	session := &muxSession{
+		conn:    conn,
+		streams: make(map[uint32]*muxStream),
+		nextID:  1, // clients use odd ids
+		accept:  accept,
+		die:     make(chan struct{}),
+	}
+	session.received()
+	session.drained = sync.NewCond(&session.mu)
+	go session.recvLoop()
+	go session.keepAlive()
+	return session
+}
+
+func (m *muxSession) isClosed() bool {
+	select {
+	case <-m.die:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *muxSession) numStreams() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.streams)
+}
+
+func (m *muxSession) close() {
+	m.dieOnce.Do(func() {
+		close(m.die)
+		m.conn.Close()
+		m.mu.Lock()
+		for _, stream := range m.streams {
+			stream.closeRead()
+		}
+		m.streams = nil
+		m.drained.Broadcast()
+		m.mu.Unlock()
+	})
+}
+
+func (m *muxSession) openStream() (*muxStream, error) {
+	m.mu.Lock()
+	if m.streams == nil {
+		m.mu.Unlock()
+		return nil, errMuxClosed
+	}
+	id := m.nextID
+	m.nextID += 2
+	stream := newMuxStream(m, id)
+	m.streams[id] = stream
+	m.mu.Unlock()
+
+	if err := m.writeFrame(smuxSYN, id, nil); err != nil {
+		m.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (m *muxSession) removeStream(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.streams != nil {
+		delete(m.streams, id)
+	}
+}
+
+// writeFrame send a frame, payload must fit in smuxMaxFrame
+func (m *muxSession) writeFrame(cmd byte, id uint32, payload []byte) error {
+	frame := make([]byte, smuxHeaderSize, smuxHeaderSize+len(payload))
+	frame[0], frame[1] = smuxVersion, cmd
+	binary.LittleEndian.PutUint16(frame[2:], uint16(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:], id)
+	frame = append(frame, payload...)
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if m.isClosed() {
+		return errMuxClosed
+	}
+	// a dead server must not block the writers forever either
+	m.conn.SetWriteDeadline(time.Now().Add(muxKeepAliveTimeout))
+	if _, err := m.conn.Write(frame); err != nil {
+		m.close()
+		return err
+	}
+	return nil
+}
+
+// recvLoop read the frames from the peer and dispatch them to the streams
+// until the connection breaks
+func (m *muxSession) recvLoop() {
+	defer m.close()
+	var header [smuxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(m.conn, header[:]); err != nil {
+			return
+		}
+		m.received()
+		if header[0] != smuxVersion {
+			logger.Println(errMuxVersion)
+			return
+		}
+		length := int(binary.LittleEndian.Uint16(header[2:]))
+		id := binary.LittleEndian.Uint32(header[4:])
+		var payload []byte
+		if length > 0 {
+			payload = make([]byte, length)
+			if _, err := io.ReadFull(m.conn, payload); err != nil {
+				return
+			}
+		}
+
+		var accepted *muxStream
+		m.mu.Lock()
+		stream := m.streams[id]
+		switch header[1] {
+		case smuxSYN:
+			if m.accept != nil && stream == nil && m.streams != nil {
+				accepted = newMuxStream(m, id)
+				m.streams[id] = accepted
+			}
+		case smuxPSH:
+			if stream != nil && length > 0 {
+				m.buffered += length
+				stream.push(payload)
+			}
+		case smuxFIN:
+			if stream != nil {
+				stream.closeRead()
+			}
+		}
+		// stop reading while the streams have too much data unread
+		if m.buffered > muxReceiveBuffer {
+			for m.buffered > muxReceiveBuffer && m.streams != nil {
+				m.drained.Wait()
+			}
+			// the peer wasn't idle, it was not read
+			m.received()
+		}
+		m.mu.Unlock()
+		if accepted != nil {
+			select {
+			case m.accept <- accepted:
+			case <-m.die:
+				return
+			}
+		}
+	}
+}
+
+// received record that a frame was just received
+func (m *muxSession) received() {
+	atomic.StoreInt64(&m.lastRecv, time.Now().UnixNano())
+}
+
+// released account for n bytes read out of a stream buffer
+func (m *muxSession) released(n int) {
+	m.mu.Lock()
+	m.buffered -= n
+	m.drained.Broadcast()
+	m.mu.Unlock()
+}
+
+// keepAlive send NOP frames, and close the session once the server sent
+// nothing for muxKeepAliveTimeout, e.g. after a NAT dropped it, unless the
+// session stopped reading because its streams are full
+func (m *muxSession) keepAlive() {
+	ticker := time.NewTicker(muxKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.die:
+			return
+		case <-ticker.C:
+			m.mu.Lock()
+			full := m.buffered > muxReceiveBuffer
+			m.mu.Unlock()
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&m.lastRecv)))
+			if !full && idle > muxKeepAliveTimeout {
+				logger.Printf("mux session to %s timed out\n", m.conn.RemoteAddr())
+				m.close()
+				return
+			}
+			m.writeFrame(smuxNOP, 0, nil)
+		}
+	}
+}
+
+// muxStream is a smux stream as a net.Conn
+type muxStream struct {
+	session *muxSession
+	id      uint32
+
+	mu           sync.Mutex
+	buffers      [][]byte
+	eof          bool
+	readDeadline time.Time
+	notify       chan struct{}
+
+	closeOnce sync.Once
+}
+
+func newMuxStream(session *muxSession, id uint32) *muxStream {
+	return &muxStream{session: session, id: id, notify: make(chan struct{}, 1)}
+}
+
+// push queue data read by the session, called with the session lock held
+func (s *muxStream) push(data []byte) {
+	s.mu.Lock()
+	s.buffers = append(s.buffers, data)
+	s.mu.Unlock()
+	s.wakeUp()
+}
+
+func (s *muxStream) closeRead() {
+	s.mu.Lock()
+	s.eof = true
+	s.mu.Unlock()
+	s.wakeUp()
+}
+
+func (s *muxStream) wakeUp() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *muxStream) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if len(s.buffers) > 0 {
+			n := copy(b, s.buffers[0])
+			s.buffers[0] = s.buffers[0][n:]
+			if len(s.buffers[0]) == 0 {
+				s.buffers = s.buffers[1:]
+			}
+			s.mu.Unlock()
+			s.session.released(n)
+			return n, nil
+		}
+		eof, deadline := s.eof, s.readDeadline
+		s.mu.Unlock()
+		if eof {
+			return 0, io.EOF
+		}
+
+		if deadline.IsZero() {
+			<-s.notify
+			continue
+		}
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, errMuxTimeout
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-s.notify:
+			timer.Stop()
+		case <-timer.C:
+			return 0, errMuxTimeout
+		}
+	}
+}
+
+func (s *muxStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > smuxMaxFrame {
+			n = smuxMaxFrame
+		}
+		if err := s.session.writeFrame(smuxPSH, s.id, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close send FIN and drop the unread data
+func (s *muxStream) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		err = s.session.writeFrame(smuxFIN, s.id, nil)
+		s.session.removeStream(s.id)
+		s.mu.Lock()
+		unread := 0
+		for _, b := range s.buffers {
+			unread += len(b)
+		}
+		s.buffers = nil
+		s.eof = true
+		s.mu.Unlock()
+		s.session.released(unread)
+		s.wakeUp()
+	})
+	return err
+}
+
+func (s *muxStream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+func (s *muxStream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
+
+func (s *muxStream) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+func (s *muxStream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	s.wakeUp()
+	return nil
+}
+
+// SetWriteDeadline is not supported, writes share the session connection
+func (s *muxStream) SetWriteDeadline(t time.Time) error {
+	return nil
+}
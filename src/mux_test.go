@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMuxPoolDialsWithoutLock(t *testing.T) {
+	p := newMuxPool(1)
+	defer p.close()
+	blocked := make(chan struct{})
+	defer close(blocked)
+	go p.session("slow:1", func() (net.Conn, error) {
+		<-blocked
+		return nil, errMuxClosed
+	})
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.session("fast:1", func() (net.Conn, error) {
+			c, _ := net.Pipe()
+			return c, nil
+		})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a slow dial blocked the sessions to another server")
+	}
+}
+
+func TestMuxServer(t *testing.T) {
+	echo := startEcho(t)
+	srv, err := NewServerService("aes-256-gcm", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startServer(t, srv)
+	s, socksAddr := startClient(t, server, "aes-256-gcm", "secret")
+	s.SetMux(1)
+
+	first := socksConnect(t, socksAddr, echo)
+	defer first.Close()
+	second := socksConnect(t, socksAddr, echo)
+	defer second.Close()
+	echoRoundTrip(t, first, "first stream")
+	echoRoundTrip(t, second, "second stream")
+	echoRoundTrip(t, first, "first stream again")
+
+	s.mux.mu.Lock()
+	sessions := len(s.mux.sessions[server])
+	s.mux.mu.Unlock()
+	if sessions != 1 {
+		t.Errorf("%d mux sessions, want the tunnels on one", sessions)
+	}
+}
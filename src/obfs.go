@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	obfsHTTP = "http"
+	obfsTLS  = "tls"
+
+	// obfsTLSMaxRecord is the largest application data record sent
+	obfsTLSMaxRecord = 16 * 1024
+	// obfsTLSHandshake is the size of the server hello and change cipher
+	// spec records before the first data record, plus its type and version
+	obfsTLSHandshake = 96 + 6 + 3
+)
+
+var errObfsResponse = errors.New("obfs: unexpected response")
+
+// obfsTransport disguise the stream as an http websocket upgrade or a tls
+// session, compatible with the servers of simple-obfs
+type obfsTransport struct {
+	mode string
+	host string
+}
+
+// NewObfsTransport return a simple-obfs transport, mode is "http" or "tls"
+// and host the Host header or server name sent, the server host if empty
+func NewObfsTransport(mode, host string) (Transport, error) {
+	if mode != obfsHTTP && mode != obfsTLS {
+		return nil, fmt.Errorf("obfs: unknown mode %q", mode)
+	}
+	return &obfsTransport{mode: mode, host: host}, nil
+}
+
+// obfsFromPluginOpts return the transport of the obfs-local options, like
+// "obfs=tls;obfs-host=www.bing.com", or nil if they are invalid
+func obfsFromPluginOpts(opts string) Transport {
+	options := pluginOptions(opts)
+	mode := options["obfs"]
+	if mode == "" {
+		mode = obfsHTTP
+	}
+	t, err := NewObfsTransport(mode, options["obfs-host"])
+	if err != nil {
+		return nil
+	}
+	return t
+}
+
+func (t *obfsTransport) Dial(server string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	host := t.host
+	if host == "" {
+		host, _, _ = net.SplitHostPort(server)
+	}
+	if t.mode == obfsTLS {
+		return &obfsTLSConn{Conn: conn, host: host}, nil
+	}
+	return &obfsHTTPConn{Conn: conn, host: host}, nil
+}
+
+// obfsHTTPConn send its first write as the body of an http upgrade request,
+// and skip the head of the response before the first read
+type obfsHTTPConn struct {
+	net.Conn
+	host   string
+	sent   bool
+	reader *bufio.Reader
+}
+
+func (c *obfsHTTPConn) Write(b []byte) (int, error) {
+	if c.sent {
+		return c.Conn.Write(b)
+	}
+	c.sent = true
+	key := make([]byte, 16)
+	rand.Read(key)
+	head := &bytes.Buffer{}
+	fmt.Fprintf(head, "GET / HTTP/1.1\r\nHost: %s\r\nUser-Agent: curl/7.%d.%d\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\n"+
+		"Content-Length: %d\r\n\r\n",
+		c.host, 50+key[0]%20, key[1]%3, base64.StdEncoding.EncodeToString(key), len(b))
+	head.Write(b)
+	if _, err := c.Conn.Write(head.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *obfsHTTPConn) Read(b []byte) (int, error) {
+	if c.reader == nil {
+		c.reader = bufio.NewReader(c.Conn)
+		resp, err := http.ReadResponse(c.reader, nil)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			return 0, errObfsResponse
+		}
+	}
+	return c.reader.Read(b)
+}
+
+// obfsTLSConn send its first write as the session ticket of a tls client
+// hello, then every write as application data records
+type obfsTLSConn struct {
+	net.Conn
+	host       string
+	sent       bool
+	handshaked bool
+	remain     int
+}
+
+func (c *obfsTLSConn) Write(b []byte) (int, error) {
+	if !c.sent {
+		c.sent = true
+		n := len(b)
+		if n > obfsTLSMaxRecord {
+			n = obfsTLSMaxRecord
+		}
+		if _, err := c.Conn.Write(obfsClientHello(b[:n], c.host)); err != nil {
+			return 0, err
+		}
+		if n == len(b) {
+			return n, nil
+		}
+		written, err := c.Write(b[n:])
+		return n + written, err
+	}
+
+	written := 0
+	buf := make([]byte, 0, 5+obfsTLSMaxRecord)
+	for len(b) > 0 {
+		n := len(b)
+		if n > obfsTLSMaxRecord {
+			n = obfsTLSMaxRecord
+		}
+		buf = append(buf[:0], 0x17, 0x03, 0x03, byte(n>>8), byte(n))
+		buf = append(buf, b[:n]...)
+		if _, err := c.Conn.Write(buf); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *obfsTLSConn) Read(b []byte) (int, error) {
+	for c.remain == 0 {
+		// skip the handshake on the first read, then the record type and
+		// version
+		skip := 3
+		if !c.handshaked {
+			c.handshaked = true
+			skip = obfsTLSHandshake
+		}
+		buf := make([]byte, skip+2)
+		if _, err := io.ReadFull(c.Conn, buf); err != nil {
+			return 0, err
+		}
+		c.remain = int(binary.BigEndian.Uint16(buf[skip:]))
+	}
+	if len(b) > c.remain {
+		b = b[:c.remain]
+	}
+	n, err := c.Conn.Read(b)
+	c.remain -= n
+	return n, err
+}
+
+// obfsClientHello return a tls 1.2 client hello for host carrying data in
+// its session ticket extension, with the extensions of a common client
+func obfsClientHello(data []byte, host string) []byte {
+	extensions := &bytes.Buffer{}
+	// session ticket
+	binary.Write(extensions, binary.BigEndian, []uint16{0x0023, uint16(len(data))})
+	extensions.Write(data)
+	// server name
+	binary.Write(extensions, binary.BigEndian, []uint16{0x0000, uint16(len(host) + 5), uint16(len(host) + 3)})
+	extensions.WriteByte(0)
+	binary.Write(extensions, binary.BigEndian, uint16(len(host)))
+	extensions.WriteString(host)
+	extensions.Write([]byte{
+		0x00, 0x0b, 0x00, 0x04, 0x03, 0x01, 0x00, 0x02, // ec point formats
+		0x00, 0x0a, 0x00, 0x0a, 0x00, 0x08, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x19, 0x00, 0x18, // groups
+		0x00, 0x0d, 0x00, 0x20, 0x00, 0x1e, 0x06, 0x01, 0x06, 0x02, 0x06, 0x03, 0x05, // signature algorithms
+		0x01, 0x05, 0x02, 0x05, 0x03, 0x04, 0x01, 0x04, 0x02, 0x04, 0x03, 0x03, 0x01,
+		0x03, 0x02, 0x03, 0x03, 0x02, 0x01, 0x02, 0x02, 0x02, 0x03,
+		0x00, 0x16, 0x00, 0x00, // encrypt then mac
+		0x00, 0x17, 0x00, 0x00, // extended master secret
+	})
+
+	hello := &bytes.Buffer{}
+	hello.Write([]byte{0x03, 0x03})
+	binary.Write(hello, binary.BigEndian, uint32(time.Now().Unix()))
+	random := make([]byte, 28+32)
+	rand.Read(random)
+	hello.Write(random[:28])
+	hello.WriteByte(32)
+	hello.Write(random[28:])
+	hello.Write([]byte{
+		0x00, 0x38, // cipher suites
+		0xc0, 0x2c, 0xc0, 0x30, 0x00, 0x9f, 0xcc, 0xa9, 0xcc, 0xa8, 0xcc, 0xaa, 0xc0, 0x2b, 0xc0, 0x2f,
+		0x00, 0x9e, 0xc0, 0x24, 0xc0, 0x28, 0x00, 0x6b, 0xc0, 0x23, 0xc0, 0x27, 0x00, 0x67, 0xc0, 0x0a,
+		0xc0, 0x14, 0x00, 0x39, 0xc0, 0x09, 0xc0, 0x13, 0x00, 0x33, 0x00, 0x9d, 0x00, 0x9c, 0x00, 0x3d,
+		0x00, 0x3c, 0x00, 0x35, 0x00, 0x2f, 0x00, 0xff,
+		0x01, 0x00, // compression
+	})
+	binary.Write(hello, binary.BigEndian, uint16(extensions.Len()))
+	extensions.WriteTo(hello)
+
+	record := &bytes.Buffer{}
+	record.Write([]byte{0x16, 0x03, 0x01})
+	binary.Write(record, binary.BigEndian, uint16(4+hello.Len()))
+	record.WriteByte(0x01) // client hello
+	record.Write([]byte{0, byte(hello.Len() >> 8), byte(hello.Len())})
+	hello.WriteTo(record)
+	return record.Bytes()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// pacTemplate is the PAC file, %s are the proxy, the rules and the default
+const pacTemplate = `var proxy = "SOCKS5 %[1]s; SOCKS %[1]s";
+var rules = %[2]s;
+function FindProxyForURL(url, host) {
+	var h = host.toLowerCase();
+	for (;;) {
+		if (rules.hasOwnProperty(h)) {
+			return rules[h] == "direct" ? "DIRECT" : proxy;
+		}
+		var i = h.indexOf(".");
+		if (i < 0) {
+			break;
+		}
+		h = h.substring(i + 1);
+	}
+	return %[3]s;
+}
+`
+
+// PACHandler return an http handler serving a PAC file which sends browsers
+// to the socks listener at socksAddr, or directly for the domains the acls
+// of the service route directly. It follows the rules as they are updated.
+// CIDR rules need name resolution and are left to the service.
+func (s *Service) PACHandler(socksAddr string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Write(s.pacFile(socksAddr))
+	})
+}
+
+// ServePAC serve the PAC file of PACHandler on listener until the service
+// stops
+func (s *Service) ServePAC(listener net.Listener, socksAddr string) error {
+	server := &http.Server{Handler: s.PACHandler(socksAddr)}
+	go func() {
+		<-s.ch
+		server.Close()
+	}()
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// pacFile generate the PAC file from the acls among the routers
+func (s *Service) pacFile(socksAddr string) []byte {
+	rules := make(map[string]string)
+	defaultTo := RouteProxy
+	for _, r := range s.routers {
+		acl, ok := r.(*ACL)
+		if !ok {
+			continue
+		}
+		if route, ok := acl.pacRules(rules); ok {
+			// the next routers are never consulted
+			defaultTo = route
+			break
+		}
+	}
+
+	encoded, _ := json.Marshal(rules)
+	fallback := "proxy"
+	if defaultTo == RouteDirect {
+		fallback = `"DIRECT"`
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, pacTemplate, socksAddr, encoded, fallback)
+	return buf.Bytes()
+}
+
+// pacRules add the domains of a to rules unless they are already there,
+// rejected domains go to the proxy which refuses them. It return the default
+// route of a if it has one.
+func (a *ACL) pacRules(rules map[string]string) (Route, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, route := range []Route{RouteReject, RouteDirect, RouteProxy} {
+		list, ok := a.lists[route]
+		if !ok {
+			continue
+		}
+		name := "proxy"
+		if route == RouteDirect {
+			name = "direct"
+		}
+		for domain := range list.domains {
+			if _, ok := rules[domain]; !ok {
+				rules[domain] = name
+			}
+		}
+	}
+	return a.defaultTo, a.hasDefault
+}
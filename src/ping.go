@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// pingTarget answers a tiny http request, it is the target the app already
+// uses to check connectivity
+const (
+	pingTarget  = "connectivitycheck.gstatic.com:80"
+	pingRequest = "HEAD /generate_204 HTTP/1.1\r\n" +
+		"Host: connectivitycheck.gstatic.com\r\n" +
+		"Connection: close\r\n\r\n"
+)
+
+// PingError is the error of Ping. Unreachable means the server couldn't be
+// connected, otherwise it didn't relay the request, most likely because the
+// method or password is wrong.
+type PingError struct {
+	Unreachable bool
+	Err         error
+}
+
+func (e *PingError) Error() string {
+	if e.Unreachable {
+		return fmt.Sprintf("server unreachable: %v", e.Err)
+	}
+	return fmt.Sprintf("server rejected the request, check method and password: %v", e.Err)
+}
+
+// Ping check the server works end to end by sending a http request through
+// it, within timeout
+func (sc *ServerCipher) Ping(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	conn, err := sc.dial(timeout)
+	if err != nil {
+		return &PingError{Unreachable: true, Err: err}
+	}
+	conn.SetDeadline(deadline)
+
+	rawaddr, err := ss.RawAddr(pingTarget)
+	if err != nil {
+		conn.Close()
+		return &PingError{Err: err}
+	}
+	remote, err := sendRequest(conn, rawaddr, sc)
+	if err != nil {
+		return &PingError{Unreachable: true, Err: err}
+	}
+	defer remote.Close()
+
+	if _, err := io.WriteString(remote, pingRequest); err != nil {
+		return &PingError{Err: err}
+	}
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(remote, reply); err != nil {
+		return &PingError{Err: err}
+	}
+	if !bytes.Equal(reply, []byte("HTTP/")) {
+		return &PingError{Err: fmt.Errorf("unexpected reply %q", reply)}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const (
+	// pluginStartTimeout is how long a plugin has to start listening
+	pluginStartTimeout = 5 * time.Second
+	pluginPollInterval = 50 * time.Millisecond
+)
+
+// pluginProcess is a running SIP003 plugin, it listens on addr and forwards
+// the connections to the server
+type pluginProcess struct {
+	cmd  *exec.Cmd
+	addr string
+	done chan struct{}
+}
+
+// startPlugin run the plugin of sc with the SIP003 environment and wait
+// until it accepts connections on its local port
+func startPlugin(sc *ServerCipher) (*pluginProcess, error) {
+	remoteHost, remotePort, err := net.SplitHostPort(sc.server)
+	if err != nil {
+		return nil, err
+	}
+	localPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	p := &pluginProcess{
+		cmd:  exec.Command(sc.plugin),
+		addr: net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)),
+		done: make(chan struct{}),
+	}
+	p.cmd.Env = append(os.Environ(),
+		"SS_REMOTE_HOST="+remoteHost,
+		"SS_REMOTE_PORT="+remotePort,
+		"SS_LOCAL_HOST=127.0.0.1",
+		"SS_LOCAL_PORT="+strconv.Itoa(localPort),
+		"SS_PLUGIN_OPTIONS="+sc.pluginOpts,
+	)
+	p.cmd.Stdout = logger.Writer()
+	p.cmd.Stderr = logger.Writer()
+	if err := p.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("plugin %s: %v", sc.plugin, err)
+	}
+	go func() {
+		err := p.cmd.Wait()
+		logger.Printf("plugin %s for %s exited: %v\n", sc.plugin, sc.server, err)
+		close(p.done)
+	}()
+
+	deadline := time.Now().Add(pluginStartTimeout)
+	for {
+		conn, err := net.DialTimeout("tcp", p.addr, pluginPollInterval)
+		if err == nil {
+			conn.Close()
+			return p, nil
+		}
+		select {
+		case <-p.done:
+			return nil, fmt.Errorf("plugin %s exited on start", sc.plugin)
+		case <-time.After(pluginPollInterval):
+		}
+		if time.Now().After(deadline) {
+			p.stop()
+			return nil, fmt.Errorf("plugin %s: not listening after %v", sc.plugin, pluginStartTimeout)
+		}
+	}
+}
+
+// running report whether the plugin process is still alive
+func (p *pluginProcess) running() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// stop kill the plugin and wait for it to exit
+func (p *pluginProcess) stop() {
+	if p.running() {
+		p.cmd.Process.Kill()
+	}
+	<-p.done
+}
+
+// freePort return a local tcp port nobody listens on
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// dialAddr return the address to dial to reach the server, the local port
+// of its plugin if it has one. The plugin is started on the first call and
+// started again if it exited.
+func (sc *ServerCipher) dialAddr() (string, error) {
+	if sc.plugin == "" || sc.transport != nil {
+		return sc.server, nil
+	}
+	sc.pluginMu.Lock()
+	defer sc.pluginMu.Unlock()
+	if sc.pluginProc == nil || !sc.pluginProc.running() {
+		p, err := startPlugin(sc)
+		if err != nil {
+			return "", err
+		}
+		sc.pluginProc = p
+	}
+	return sc.pluginProc.addr, nil
+}
+
+// stopPlugin stop the plugin of the server if it is running
+func (sc *ServerCipher) stopPlugin() {
+	sc.pluginMu.Lock()
+	defer sc.pluginMu.Unlock()
+	if sc.pluginProc != nil {
+		sc.pluginProc.stop()
+		sc.pluginProc = nil
+	}
+}
+
+// handOverPlugins give the running plugins of the servers in old to the
+// servers of list with the same address, plugin and options, e.g. rebuilt by
+// a reload, so the tunnels through them are not dropped
+func handOverPlugins(old, list []*ServerCipher) {
+	for _, sc := range old {
+		for _, n := range list {
+			if n == sc || n.server != sc.server || n.plugin != sc.plugin || n.pluginOpts != sc.pluginOpts {
+				continue
+			}
+			sc.pluginMu.Lock()
+			n.pluginMu.Lock()
+			if n.pluginProc == nil && sc.pluginProc != nil {
+				n.pluginProc, sc.pluginProc = sc.pluginProc, nil
+			}
+			n.pluginMu.Unlock()
+			sc.pluginMu.Unlock()
+		}
+	}
+}
+
+// stopPlugins stop the plugins of the servers in old which are not in keep
+func stopPlugins(old, keep []*ServerCipher) {
+	for _, sc := range old {
+		kept := false
+		for _, k := range keep {
+			if k == sc {
+				kept = true
+				break
+			}
+		}
+		if !kept {
+			sc.stopPlugin()
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestHandOverPlugins(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+	proc := &pluginProcess{addr: "127.0.0.1:1", done: done}
+	old := &ServerCipher{server: "example.com:8388", plugin: "obfs", pluginOpts: "obfs=http", pluginProc: proc}
+	other := &ServerCipher{server: "example.com:8388", plugin: "obfs", pluginOpts: "obfs=tls"}
+	same := &ServerCipher{server: "example.com:8388", plugin: "obfs", pluginOpts: "obfs=http"}
+
+	list := []*ServerCipher{other, same}
+	handOverPlugins([]*ServerCipher{old}, list)
+	stopPlugins([]*ServerCipher{old}, list)
+	if same.pluginProc != proc {
+		t.Error("plugin not handed over to the server with the same options")
+	}
+	if other.pluginProc != nil || old.pluginProc != nil {
+		t.Error("plugin handed over to the wrong server")
+	}
+}
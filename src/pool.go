@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// poolIdleTimeout is how long a warm connection is kept, servers close
+	// idle connections on their own so older ones are likely dead
+	poolIdleTimeout = 30 * time.Second
+	poolDialTimeout = 10 * time.Second
+)
+
+// serverPool keeps tcp connections to the servers dialed ahead of time.
+// The shadowsocks framing can't be reused across tunnels, so connections are
+// pooled before the cipher is bound to them and each one is used only once.
+type serverPool struct {
+	size   int
+	dial   func(server string, timeout time.Duration) (net.Conn, error)
+	mu     sync.Mutex
+	conns  map[string]chan *pooledConn
+	closed bool
+}
+
+type pooledConn struct {
+	net.Conn
+	dialed time.Time
+}
+
+// newServerPool return a pool of size connections per server, dialed with
+// dial
+func newServerPool(size int, dial func(server string, timeout time.Duration) (net.Conn, error)) *serverPool {
+	return &serverPool{
+		size:  size,
+		dial:  dial,
+		conns: make(map[string]chan *pooledConn),
+	}
+}
+
+// get return a warm connection to server, or nil if there is none. Every
+// call schedules a new connection to replace the one taken.
+func (p *serverPool) get(server string) net.Conn {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	ch, ok := p.conns[server]
+	if !ok {
+		ch = make(chan *pooledConn, p.size)
+		p.conns[server] = ch
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		go p.fill(server, ch, p.size)
+		return nil
+	}
+
+	for {
+		select {
+		case conn, ok := <-ch:
+			if !ok {
+				// drained
+				return nil
+			}
+			go p.fill(server, ch, 1)
+			if p.alive(conn) {
+				return conn.Conn
+			}
+			conn.Close()
+		default:
+			go p.fill(server, ch, 1)
+			return nil
+		}
+	}
+}
+
+// fill dial n connections to server and put them into ch
+func (p *serverPool) fill(server string, ch chan *pooledConn, n int) {
+	for i := 0; i < n; i++ {
+		conn, err := p.dial(server, poolDialTimeout)
+		if err != nil {
+			return
+		}
+		p.put(ch, &pooledConn{conn, time.Now()})
+	}
+}
+
+func (p *serverPool) put(ch chan *pooledConn, conn *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		conn.Close()
+		return
+	}
+	select {
+	case ch <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// alive check a warm connection before it is used. The server never sends
+// anything first, so a read must time out unless the connection is closed.
+func (p *serverPool) alive(conn *pooledConn) bool {
+	if time.Since(conn.dialed) > poolIdleTimeout {
+		return false
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	conn.SetReadDeadline(time.Time{})
+	return isTimeout(err)
+}
+
+// drain close all warm connections, the pool can't be used afterwards
+func (p *serverPool) drain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	for _, ch := range p.conns {
+		close(ch)
+		for conn := range ch {
+			conn.Close()
+		}
+	}
+}
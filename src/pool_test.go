@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPoolDialsThroughHosts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	hosts, _ := NewHosts(map[string]string{"server.test": "127.0.0.1"})
+	s := &Service{hosts: hosts}
+	s.SetServerPoolSize(1)
+	defer s.pool.drain()
+	server := net.JoinHostPort("server.test", port)
+	s.pool.get(server)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if conn := s.pool.get(server); conn != nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no warm connection to the overridden server")
+}
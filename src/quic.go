@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// quicALPN is the application protocol negotiated with the server
+	quicALPN = "ss-quic"
+
+	quicDialTimeout = 10 * time.Second
+	quicIdleTimeout = 60 * time.Second
+)
+
+// quicTransport carry every stream to a server on its own stream of a single
+// QUIC connection, which recovers from losses better than tcp on lossy links
+type quicTransport struct {
+	tls *tlsTransport
+
+	mu    sync.Mutex
+	conns map[string]*quic.Conn
+}
+
+// NewQUICTransport return a QUIC transport, serverName and pin are checked
+// like with NewTLSTransport
+func NewQUICTransport(serverName, pin string) (Transport, error) {
+	t, err := newTLSTransport(serverName, pin)
+	if err != nil {
+		return nil, err
+	}
+	return &quicTransport{tls: t, conns: make(map[string]*quic.Conn)}, nil
+}
+
+func (t *quicTransport) Dial(server string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), quicDialTimeout)
+	defer cancel()
+	conn, err := t.conn(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		// the connection may have died since, the next dial replaces it
+		t.forget(server, conn)
+		return nil, err
+	}
+	return &quicStream{Stream: stream, conn: conn}, nil
+}
+
+// conn return the connection to server, dialing it if there is none or it
+// was closed
+func (t *quicTransport) conn(ctx context.Context, server string) (*quic.Conn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if conn, ok := t.conns[server]; ok {
+		select {
+		case <-conn.Context().Done():
+		default:
+			return conn, nil
+		}
+	}
+	config := t.tls.config(server)
+	config.NextProtos = []string{quicALPN}
+	conn, err := quic.DialAddr(ctx, server, config, &quic.Config{
+		MaxIdleTimeout:  quicIdleTimeout,
+		KeepAlivePeriod: quicIdleTimeout / 2,
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.conns[server] = conn
+	return conn, nil
+}
+
+// forget drop conn if it is still the connection to server
+func (t *quicTransport) forget(server string, conn *quic.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns[server] == conn {
+		delete(t.conns, server)
+		conn.CloseWithError(0, "")
+	}
+}
+
+// quicStream is a QUIC stream as a net.Conn
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Close close both directions, Stream.Close only closes the write side
+func (s *quicStream) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by all tunnels. Callers reserve
+// tokens and sleep off the debt, so the bucket may go below zero.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func newRateLimiter(bytesPerSecond int, now func() time.Time) *rateLimiter {
+	rate := float64(bytesPerSecond)
+	return &rateLimiter{
+		rate:   rate,
+		burst:  rate,
+		tokens: rate,
+		last:   now(),
+		now:    now,
+	}
+}
+
+// wait block until n tokens are available, or the service stops
+func (l *rateLimiter) wait(n float64, stop <-chan bool) {
+	l.mu.Lock()
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= n
+	debt := l.tokens
+	l.mu.Unlock()
+
+	if debt >= 0 {
+		return
+	}
+	timer := time.NewTimer(time.Duration(-debt / l.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-stop:
+	}
+}
+
+// SetRateLimit limit the total throughput of all tunnels, both directions
+// together, to bytesPerSecond, zero means no limit. Limited tunnels are
+// always copied in user space.
+func (s *Service) SetRateLimit(bytesPerSecond int) {
+	s.limiter = nil
+	if bytesPerSecond > 0 {
+		s.limiter = newRateLimiter(bytesPerSecond, s.now)
+	}
+}
+
+// SetPortPriority classify tunnels by destination port. A tunnel gets a
+// share of the rate limit in proportion to its priority, ports not in the
+// map have priority 1.
+func (s *Service) SetPortPriority(priority map[int]int) {
+	s.portPriority = make(map[int]int, len(priority))
+	s.maxPriority = 1
+	for port, p := range priority {
+		if p < 1 {
+			p = 1
+		}
+		s.portPriority[port] = p
+		if p > s.maxPriority {
+			s.maxPriority = p
+		}
+	}
+}
+
+// priority return the priority of a tunnel to addr
+func (s *Service) priority(addr string) int {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 1
+	}
+	port, _ := strconv.Atoi(portStr)
+	if p, ok := s.portPriority[port]; ok {
+		return p
+	}
+	return 1
+}
+
+// throttle wait for the rate limiter before n bytes of t are written. The
+// highest priority pays one token per byte, lower ones pay more, so the
+// limit still holds and busy low priority tunnels leave room to others.
+func (s *Service) throttle(t *tunnel, n int) {
+	if s.limiter == nil {
+		return
+	}
+	cost := float64(n) * float64(s.maxPriority) / float64(t.priority)
+	s.limiter.wait(cost, s.ch)
+}
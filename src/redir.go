@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// ServeRedir to serve a listener receiving connections redirected by
+// iptables (-j REDIRECT), which are tunneled to their original destination.
+// It is only supported on Linux.
+func (s *Service) ServeRedir(listener *net.TCPListener) error {
+	return s.serve(s.handleRedirConnection, []*net.TCPListener{listener})
+}
+
+// handleRedirConnection tunnel a redirected connection to the destination
+// it was sent to
+func (s *Service) handleRedirConnection(conn net.Conn) {
+	defer s.waitGroup.Done()
+	defer conn.Close()
+
+	remoteAddr := conn.RemoteAddr().String()
+	s.publish(ConnEvent{Type: ConnAccepted, Remote: remoteAddr})
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	dst, err := originalDst(tcpConn)
+	if err != nil {
+		s.debug.Println("original destination:", err)
+		return
+	}
+	s.tunnelTransparent(conn, dst)
+}
+
+// tunnelTransparent tunnel a connection intercepted on its way to dst, or
+// to its domain if dst is a fake address. The client believes it is
+// connected to dst already, so it gets no reply.
+func (s *Service) tunnelTransparent(conn net.Conn, dst *net.TCPAddr) {
+	rawaddr, addr, ok := s.transparentAddr(dst.IP, dst.Port)
+	if !ok {
+		s.debug.Println("unknown fake address:", dst)
+		return
+	}
+	s.tunnelRequest(conn, rawaddr, addr, func(rep byte) error {
+		return nil
+	})
+}
+
+// ipRawAddr return the socks address of ip and port
+func ipRawAddr(ip net.IP, port int) []byte {
+	var rawaddr []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		rawaddr = append([]byte{typeIPv4}, ip4...)
+	} else {
+		rawaddr = append([]byte{typeIPv6}, ip.To16()...)
+	}
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(port))
+	return append(rawaddr, b[:]...)
+}
@@ -0,0 +1,59 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST, the
+// destination of a connection before iptables redirected it
+const soOriginalDst = 80
+
+// originalDst return the destination conn was sent to before being
+// redirected to the local listener
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	ipv4 := local == nil || local.IP.To4() != nil
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if ipv4 {
+			// the option fills a sockaddr_in, IPv6Mreq is large enough
+			var mreq *syscall.IPv6Mreq
+			mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if sockErr != nil {
+				return
+			}
+			sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(mreq))
+			addr = &net.TCPAddr{IP: net.IP(append([]byte{}, sa.Addr[:]...)), Port: ntohs(sa.Port)}
+			return
+		}
+		// likewise IPv6MTUInfo holds a sockaddr_in6
+		var info *syscall.IPv6MTUInfo
+		info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if sockErr != nil {
+			return
+		}
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(&info.Addr))
+		addr = &net.TCPAddr{IP: net.IP(append([]byte{}, sa.Addr[:]...)), Port: ntohs(sa.Port)}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, sockErr
+}
+
+// ntohs convert a port in network byte order as read from a sockaddr
+func ntohs(port uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return int(b[0])<<8 | int(b[1])
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// originalDst fail where the original destination of redirected connections
+// can't be read
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errors.New("transparent proxy is only supported on Linux")
+}
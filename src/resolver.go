@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// resolveTimeout is how long resolving a host with a Resolver may take
+const resolveTimeout = 5 * time.Second
+
+// Resolver resolve the hosts of the connections made without the servers
+type Resolver interface {
+	LookupIP(host string) ([]net.IP, error)
+}
+
+// SetResolver set the resolver of the hosts connected directly, instead of
+// the system one whose answers may be poisoned. Nil restores the system
+// resolver.
+func (s *Service) SetResolver(r Resolver) {
+	s.resolver = r
+}
+
+// secureResolver resolve hosts by sending dns messages with exchange
+type secureResolver struct {
+	exchange func(query []byte) ([]byte, error)
+}
+
+// NewSecureResolver return a resolver for endpoint, the url of a DNS over
+// HTTPS resolver like "https://1.1.1.1/dns-query", or a DNS over TLS one
+// written "tls://host[:port]", port 853 by default. The host of the endpoint
+// itself is resolved by the system.
+func NewSecureResolver(endpoint string) (Resolver, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "https":
+		return NewDoHResolver(endpoint), nil
+	case "tls":
+		server := u.Host
+		if u.Port() == "" {
+			server = net.JoinHostPort(u.Hostname(), "853")
+		}
+		return NewDoTResolver(server, u.Hostname()), nil
+	}
+	return nil, fmt.Errorf("unsupported resolver %q", endpoint)
+}
+
+// NewDoHResolver return a resolver sending its queries to the DNS over HTTPS
+// resolver at url (RFC 8484)
+func NewDoHResolver(url string) Resolver {
+	client := &http.Client{Timeout: resolveTimeout}
+	return &secureResolver{exchange: func(query []byte) ([]byte, error) {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(query))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/dns-message")
+		req.Header.Set("Accept", "application/dns-message")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: %s", url, resp.Status)
+		}
+		return ioutil.ReadAll(io.LimitReader(resp.Body, dnsMaxMessage))
+	}}
+}
+
+// NewDoTResolver return a resolver sending its queries to the DNS over TLS
+// resolver at server, a host:port, whose certificate is for serverName
+// (RFC 7858)
+func NewDoTResolver(server, serverName string) Resolver {
+	config := &tls.Config{ServerName: serverName}
+	return &secureResolver{exchange: func(query []byte) ([]byte, error) {
+		conn, err := dialTLS(server, config)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(resolveTimeout))
+		return exchangeDNSStream(conn, query)
+	}}
+}
+
+// exchangeDNSStream send query on conn, framed as over tcp, and return the
+// answer
+func exchangeDNSStream(conn net.Conn, query []byte) ([]byte, error) {
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// LookupIP query the A and AAAA records of host at once
+func (r *secureResolver) LookupIP(host string) ([]net.IP, error) {
+	ips, _, err := r.lookupIPTTL(host)
+	return ips, err
+}
+
+// lookupIPTTL is LookupIP also returning how long the addresses are valid
+func (r *secureResolver) lookupIPTTL(host string) ([]net.IP, time.Duration, error) {
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	v4, v6 := make(chan result, 1), make(chan result, 1)
+	go func() {
+		ips, ttl, err := r.lookup(host, dnsmessage.TypeA)
+		v4 <- result{ips, ttl, err}
+	}()
+	go func() {
+		ips, ttl, err := r.lookup(host, dnsmessage.TypeAAAA)
+		v6 <- result{ips, ttl, err}
+	}()
+	a, aaaa := <-v4, <-v6
+	if ips := append(a.ips, aaaa.ips...); len(ips) > 0 {
+		ttl := a.ttl
+		if len(a.ips) == 0 || len(aaaa.ips) > 0 && aaaa.ttl < ttl {
+			ttl = aaaa.ttl
+		}
+		return ips, ttl, nil
+	}
+	if a.err != nil {
+		return nil, 0, a.err
+	}
+	if aaaa.err != nil {
+		return nil, 0, aaaa.err
+	}
+	return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// lookup return the addresses of the records of type qtype of host and
+// their ttl
+func (r *secureResolver) lookup(host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	query, err := newDNSQuery(host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	answer, err := r.exchange(query)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(answer); err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	if msg.RCode == dnsmessage.RCodeNameError {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, &net.DNSError{Err: msg.RCode.String(), Name: host}
+	}
+	var ips []net.IP
+	for _, rr := range msg.Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		}
+	}
+	return ips, answerTTL(&msg), nil
+}
+
+// newDNSQuery return a recursive query of the records of type qtype of host
+func newDNSQuery(host string, qtype dnsmessage.Type) ([]byte, error) {
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	name, err := dnsmessage.NewName(host)
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	return msg.Pack()
+}
+
+// systemResolver resolve hosts with the resolver of the system
+type systemResolver struct{}
+
+func (systemResolver) LookupIP(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
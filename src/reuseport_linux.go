@@ -0,0 +1,47 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// ListenReusePort create n listeners on addr with SO_REUSEPORT, so the
+// kernel spreads incoming connections among them. Serve them together with
+// ServeAll to run an accept loop for each.
+func ListenReusePort(addr string, n int) ([]*net.TCPListener, error) {
+	if n < 1 {
+		n = 1
+	}
+	lc := net.ListenConfig{Control: reusePortControl}
+	listeners := make([]*net.TCPListener, 0, n)
+	for i := 0; i < n; i++ {
+		listener, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener.(*net.TCPListener))
+		// with port 0 the others must share the port picked for the first
+		addr = listener.Addr().String()
+	}
+	return listeners, nil
+}
+
+// soReusePort is SO_REUSEPORT, the syscall package lacks it on some archs
+const soReusePort = 0xf
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "net"
+
+// ListenReusePort return a single listener on addr, SO_REUSEPORT is only
+// used on Linux
+func ListenReusePort(addr string, n int) ([]*net.TCPListener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return []*net.TCPListener{listener}, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Router choose the route of a destination, ok is false when it has no rule
+// for it and the next router decides
+type Router interface {
+	Route(host string, port int) (route Route, ok bool)
+}
+
+// AddRouter add a router deciding the route of every request, routers are
+// consulted in the order they are added and destinations none of them
+// decides go through the servers. It must be called before serving.
+func (s *Service) AddRouter(r Router) {
+	s.routers = append(s.routers, r)
+}
+
+// SetBypassLAN set whether loopback, private and link-local destinations are
+// connected directly, the server can't reach the local network anyway.
+// They are checked before the routers.
+func (s *Service) SetBypassLAN(bypass bool) {
+	s.bypassLAN = bypass
+}
+
+// isLocalHost report whether host is on the local network, an address or a
+// local name
+func isLocalHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return host == "localhost" || strings.HasSuffix(host, ".localhost") || strings.HasSuffix(host, ".local")
+}
+
+// route return the route of addr, a host and port
+func (s *Service) route(addr string) Route {
+	if len(s.routers) == 0 && !s.bypassLAN && s.blocklist == nil {
+		return RouteProxy
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return RouteProxy
+	}
+	port, _ := strconv.Atoi(portStr)
+	if s.blocklist != nil {
+		if route, ok := s.blocklist.Route(host, port); ok {
+			return route
+		}
+	}
+	if s.bypassLAN && isLocalHost(host) {
+		return RouteDirect
+	}
+	for _, r := range s.routers {
+		if route, ok := r.Route(host, port); ok {
+			return route
+		}
+	}
+	return RouteProxy
+}
+
+// tunnelDirect connect to addr without the servers and relay conn with it,
+// reply tells the client the outcome with a socks reply code
+func (s *Service) tunnelDirect(conn net.Conn, addr string, reply func(rep byte) error) {
+	remoteAddr := conn.RemoteAddr().String()
+	remote, err := s.dialDirect(addr)
+	if err != nil {
+		s.debug.Println("direct:", err)
+		reply(dialFailureReply(err))
+		return
+	}
+	if err := reply(repSucceeded); err != nil {
+		s.debug.Println("send connection confirmation:", err)
+		remote.Close()
+		return
+	}
+	s.publish(ConnEvent{Type: ConnEstablished, Remote: remoteAddr, Destination: addr})
+	s.debug.Printf("connected to %s directly\n", addr)
+	if s.accessLog {
+		s.logger.Printf("connected to %s directly", addr)
+	}
+	s.applySocketOptions(conn)
+	s.applySocketOptions(remote)
+
+	start := s.now()
+	counter := s.routeCounter(RouteDirect)
+	s.relay(conn, remote, s.newTunnel(addr, counter))
+	s.debug.Println("closed direct connection to", addr)
+	stats := counter.stats()
+	s.publish(ConnEvent{
+		Type:        ConnClosed,
+		Remote:      remoteAddr,
+		Destination: addr,
+		Sent:        stats.Sent,
+		Received:    stats.Received,
+	})
+	s.summarize(addr, "", start, stats)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ServerService is a shadowsocks server. It decrypts the connections of
+// shadowsocks clients and relays them to the address they request, with the
+// buffers, stats and lifecycle of Service. Destinations are dialed like the
+// direct connections of Service, their address families racing. The mux
+// sessions of clients using Service.SetMux are served too.
+type ServerService struct {
+	service *Service
+	cipher  Cipher
+	codecs  map[string]Codec
+}
+
+// NewServerService return a server for clients using method and password
+func NewServerService(method, password string) (*ServerService, error) {
+	serverCipher, err := NewServerCipher("", method, password)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := serverCipher.cipher.(*ss2022Cipher); ok {
+		return nil, fmt.Errorf("cipher %s: not supported by the server", method)
+	}
+	return &ServerService{
+		service: NewService(serverCipher),
+		cipher:  serverCipher.cipher,
+	}, nil
+}
+
+// SetCodecs set the codecs applied to the tunnels of clients offering one of
+// them, see Service.SetCodec. Clients offering another one are answered that
+// the codec is refused and their tunnel is left untouched.
+func (srv *ServerService) SetCodecs(codecs ...Codec) {
+	srv.codecs = make(map[string]Codec, len(codecs))
+	for _, codec := range codecs {
+		srv.codecs[codec.Name()] = codec
+	}
+}
+
+// Serve to serve a listener of shadowsocks clients, it returns nil when the
+// server stops or the error which broke the listener
+func (srv *ServerService) Serve(listener *net.TCPListener) error {
+	return srv.service.serve(srv.handleConnection, []*net.TCPListener{listener})
+}
+
+// Stop close the listeners and all the connections
+func (srv *ServerService) Stop() {
+	srv.service.Stop()
+}
+
+// Quiesce stop accepting new connections, see Service.Quiesce
+func (srv *ServerService) Quiesce() {
+	srv.service.Quiesce()
+}
+
+// Wait block until the listeners are closed and all the connections are done
+func (srv *ServerService) Wait() {
+	srv.service.Wait()
+}
+
+// Stats return the traffic relayed since the server started, sent is from
+// the clients to their targets
+func (srv *ServerService) Stats() TrafficStats {
+	return srv.service.Stats()
+}
+
+// Service return the service behind the server, to set its timeouts and
+// listeners
+func (srv *ServerService) Service() *Service {
+	return srv.service
+}
+
+func (srv *ServerService) handleConnection(conn net.Conn) {
+	s := srv.service
+	defer s.waitGroup.Done()
+	defer conn.Close()
+
+	remoteAddr := conn.RemoteAddr().String()
+	s.publish(ConnEvent{Type: ConnAccepted, Remote: remoteAddr})
+
+	s.setHandshakeDeadline(conn)
+	client, host, err := srv.handshake(srv.cipher.StreamConn(conn), remoteAddr)
+	if err != nil {
+		s.handshakeFailed(conn.RemoteAddr(), err)
+		return
+	}
+	if host == muxTarget {
+		conn.SetReadDeadline(time.Time{})
+		srv.serveMux(client)
+		return
+	}
+	s.applySocketOptions(conn)
+	srv.tunnel(client, remoteAddr, host)
+}
+
+// handshake read the target of the tunnel client asks for and answer its
+// codec offer
+func (srv *ServerService) handshake(client net.Conn, remoteAddr string) (net.Conn, string, error) {
+	s := srv.service
+	host, offered, err := readTarget(client)
+	if err == nil && offered {
+		client, err = srv.acceptCodec(client)
+	}
+	if err != nil {
+		s.debug.Println("error getting target:", err)
+		s.publish(ConnEvent{Type: ConnHandshakeFailed, Remote: remoteAddr, Err: err})
+		return nil, "", err
+	}
+	return client, host, nil
+}
+
+// serveMux serve the mux session client opened, each of its streams starts
+// with the target of its tunnel like a connection does, until the session
+// or the server is closed
+func (srv *ServerService) serveMux(client net.Conn) {
+	s := srv.service
+	session := newMuxServerSession(client)
+	defer session.close()
+	for {
+		select {
+		case stream := <-session.accept:
+			s.waitGroup.Add(1)
+			go func() {
+				defer s.waitGroup.Done()
+				defer stream.Close()
+				remoteAddr := client.RemoteAddr().String()
+				s.setHandshakeDeadline(stream)
+				conn, host, err := srv.handshake(stream, remoteAddr)
+				if err == nil {
+					srv.tunnel(conn, remoteAddr, host)
+				}
+			}()
+		case <-session.die:
+			return
+		case <-s.ch:
+			return
+		}
+	}
+}
+
+// tunnel connect to host and relay client with it
+func (srv *ServerService) tunnel(client net.Conn, remoteAddr, host string) {
+	s := srv.service
+	remote, err := s.dialDirect(host)
+	if err != nil {
+		s.debug.Println("dial target:", err)
+		s.publish(ConnEvent{Type: ConnDialFailed, Remote: remoteAddr, Destination: host, Err: err})
+		return
+	}
+	s.publish(ConnEvent{Type: ConnEstablished, Remote: remoteAddr, Destination: host})
+	s.debug.Printf("connected %s to %s\n", remoteAddr, host)
+	if s.accessLog {
+		s.logger.Printf("connected %s to %s", remoteAddr, host)
+	}
+	s.applySocketOptions(remote)
+
+	start := s.now()
+	counter := s.routeCounter(RouteDirect)
+	s.relay(client, remote, s.newTunnel(host, counter))
+	s.debug.Println("closed connection to", host)
+
+	stats := counter.stats()
+	s.publish(ConnEvent{
+		Type:        ConnClosed,
+		Remote:      remoteAddr,
+		Destination: host,
+		Sent:        stats.Sent,
+		Received:    stats.Received,
+	})
+	s.summarize(host, "", start, stats)
+}
+
+// acceptCodec answer the codec offered by the client on conn and return
+// conn wrapped by the codec if the server has it
+func (srv *ServerService) acceptCodec(conn net.Conn) (net.Conn, error) {
+	name, err := readCodecOffer(conn)
+	if err != nil {
+		return nil, err
+	}
+	codec, ok := srv.codecs[name]
+	answer := []byte{0}
+	if ok {
+		answer[0] = 1
+	}
+	if _, err := conn.Write(answer); err != nil {
+		return nil, err
+	}
+	if !ok {
+		srv.service.debug.Println("codec refused:", name)
+		return conn, nil
+	}
+	return codec.Wrap(conn), nil
+}
+
+// readTarget read the address a shadowsocks client asks to connect to, at
+// the start of the decrypted stream, and whether a codec offer follows it
+func readTarget(r io.Reader) (host string, offered bool, err error) {
+	var buf [1 + 1 + 255 + 2]byte
+	if _, err = io.ReadFull(r, buf[:2]); err != nil {
+		return
+	}
+	offered = buf[0]&codecFlag != 0
+	buf[0] &^= codecFlag
+	var n int
+	switch buf[0] {
+	case typeIPv4:
+		n = 1 + net.IPv4len + 2
+	case typeIPv6:
+		n = 1 + net.IPv6len + 2
+	case typeDm:
+		if buf[1] == 0 {
+			return "", false, ErrDomainLen
+		}
+		n = 1 + 1 + int(buf[1]) + 2
+	default:
+		return "", false, ErrAddrType
+	}
+	if _, err = io.ReadFull(r, buf[2:n]); err != nil {
+		return
+	}
+	return udpAddrHost(buf[:n], n), offered, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// listenTCP return a tcp listener on a free loopback port
+func listenTCP(t testing.TB) *net.TCPListener {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// startEcho serve an echo server until the test ends and return its address
+func startEcho(t testing.TB) string {
+	l := listenTCP(t)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startServer serve srv until the test ends and return its address
+func startServer(t testing.TB, srv *ServerService) string {
+	l := listenTCP(t)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return l.Addr().String()
+}
+
+// startClient serve a socks service for server until the test ends and
+// return the service and its address
+func startClient(t testing.TB, server, method, password string) (*Service, string) {
+	serverCipher, err := NewServerCipher(server, method, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(serverCipher)
+	l := listenTCP(t)
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+	return s, l.Addr().String()
+}
+
+// socksConnect open a socks5 connection to target through the proxy at
+// socksAddr
+func socksConnect(t testing.TB, socksAddr, target string) net.Conn {
+	conn, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	addr, _ := net.ResolveTCPAddr("tcp", target)
+	var method [2]byte
+	conn.Write([]byte{socksVer5, 1, methodNoAuth})
+	if _, err := io.ReadFull(conn, method[:]); err != nil {
+		t.Fatal(err)
+	}
+	req := []byte{socksVer5, socksCmdConnect, 0, typeIPv4}
+	req = append(req, addr.IP.To4()...)
+	req = append(req, byte(addr.Port>>8), byte(addr.Port))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 3+1+net.IPv4len+2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != repSucceeded {
+		t.Fatalf("connect %s: reply %d", target, reply[1])
+	}
+	return conn
+}
+
+// echoRoundTrip check that msg comes back unchanged through conn
+func echoRoundTrip(t testing.TB, conn net.Conn, msg string) {
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		t.Fatal(err)
+	}
+	if string(echo) != msg {
+		t.Fatalf("echo %q, want %q", echo, msg)
+	}
+}
+
+func TestServerRelay(t *testing.T) {
+	echo := startEcho(t)
+	srv, err := NewServerService("aes-256-gcm", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, socksAddr := startClient(t, startServer(t, srv), "aes-256-gcm", "secret")
+	conn := socksConnect(t, socksAddr, echo)
+	defer conn.Close()
+	echoRoundTrip(t, conn, "hello through the server")
+}
+
+// summaryListener send the summaries of the closed tunnels to its channel
+type summaryListener chan ConnSummary
+
+func (l summaryListener) ConnClosed(summary ConnSummary) { l <- summary }
+
+// nextSummary wait for the next summary of l
+func nextSummary(t testing.TB, l summaryListener) ConnSummary {
+	select {
+	case summary := <-l:
+		return summary
+	case <-time.After(5 * time.Second):
+		t.Fatal("no summary of the closed tunnel")
+		return ConnSummary{}
+	}
+}
+
+func TestServerRelaySummary(t *testing.T) {
+	echo := startEcho(t)
+	srv, err := NewServerService("aes-256-gcm", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverSummaries := make(summaryListener, 1)
+	srv.Service().SetConnCloseListener(serverSummaries)
+	server := startServer(t, srv)
+	s, socksAddr := startClient(t, server, "aes-256-gcm", "secret")
+	clientSummaries := make(summaryListener, 1)
+	s.SetConnCloseListener(clientSummaries)
+
+	msg := "hello through the server"
+	conn := socksConnect(t, socksAddr, echo)
+	echoRoundTrip(t, conn, msg)
+	conn.Close()
+
+	got := nextSummary(t, clientSummaries)
+	if got.Destination != echo || got.Server != server || got.Sent != uint64(len(msg)) {
+		t.Errorf("client summary %+v", got)
+	}
+	got = nextSummary(t, serverSummaries)
+	if got.Destination != echo || got.Server != "" || got.Received != uint64(len(msg)) {
+		t.Errorf("server summary %+v", got)
+	}
+}
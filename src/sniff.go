@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+const (
+	// sniffTimeout is how long to wait for the first bytes of the client,
+	// protocols where the server speaks first are not delayed more
+	sniffTimeout = 300 * time.Millisecond
+	// sniffMaxBytes is the most read ahead to find the host
+	sniffMaxBytes = 8192
+)
+
+// SetSniffing set whether the host of the requests carrying an address is
+// sniffed from the first bytes sent by the client, the server name of tls or
+// the Host header of http. Those requests are answered at once so the client
+// sends them, a failure to connect or a blocked destination then resets the
+// connection instead of sending a failure reply. The request
+// is turned into one for the host, which the routers, the logs and the
+// events see, and which the servers resolve.
+func (s *Service) SetSniffing(enable bool) {
+	s.sniff = enable
+}
+
+// SetRemoteDNS set whether the servers resolve the destinations. The requests
+// carrying an address, which the client resolved itself, are sniffed as with
+// SetSniffing and turned back into requests for the host they name, so
+// answers poisoned by the local resolver are not used. Domains are always
+// sent to the servers as is, whatever the mode, but GeoIP routing resolves
+// them locally.
+func (s *Service) SetRemoteDNS(enable bool) {
+	s.remoteDNS = enable
+}
+
+// sniffHost read ahead the first bytes sent by the client on conn and return
+// the server name of a tls client hello or the Host header of an http
+// request, empty if there is none. The returned connection replays the
+// bytes read.
+func sniffHost(conn net.Conn) (net.Conn, string) {
+	r := bufio.NewReaderSize(conn, sniffMaxBytes)
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	conn = &bufferedConn{conn, r}
+
+	if _, err := r.Peek(1); err != nil {
+		return conn, ""
+	}
+	data, _ := r.Peek(r.Buffered())
+	if data[0] == 0x16 && len(data) >= 5 {
+		// the client hello may span several segments
+		n := 5 + int(binary.BigEndian.Uint16(data[3:5]))
+		if n > sniffMaxBytes {
+			n = sniffMaxBytes
+		}
+		data, _ = r.Peek(n)
+		return conn, parseSNI(data)
+	}
+	return conn, parseHTTPHost(data)
+}
+
+// parseSNI return the server name of the tls client hello in data
+func parseSNI(data []byte) string {
+	// record header, handshake type and length, version and random
+	const helloStart = 5 + 4 + 2 + 32
+	if len(data) < helloStart+1 || data[0] != 0x16 || data[5] != 0x01 {
+		return ""
+	}
+	b := data[helloStart:]
+	skip := func(lenSize int) bool {
+		if len(b) < lenSize {
+			return false
+		}
+		n := 0
+		for _, c := range b[:lenSize] {
+			n = n<<8 | int(c)
+		}
+		if len(b) < lenSize+n {
+			return false
+		}
+		b = b[lenSize+n:]
+		return true
+	}
+	// session id, cipher suites, compression methods
+	if !skip(1) || !skip(2) || !skip(1) || len(b) < 2 {
+		return ""
+	}
+	b = b[2:] // extensions length
+	for len(b) >= 4 {
+		extType := binary.BigEndian.Uint16(b)
+		extLen := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+extLen {
+			return ""
+		}
+		ext := b[4 : 4+extLen]
+		b = b[4+extLen:]
+		if extType != 0 {
+			continue
+		}
+		// server name list length, name type, name length
+		if len(ext) < 5 || ext[2] != 0 {
+			return ""
+		}
+		n := int(binary.BigEndian.Uint16(ext[3:]))
+		if len(ext) < 5+n {
+			return ""
+		}
+		return string(ext[5 : 5+n])
+	}
+	return ""
+}
+
+// parseHTTPHost return the host of the Host header of the http request in
+// data, without port
+func parseHTTPHost(data []byte) string {
+	if len(data) == 0 || strings.IndexByte(httpMethodInitials, data[0]) < 0 {
+		return ""
+	}
+	if end := bytes.Index(data, []byte("\r\n\r\n")); end >= 0 {
+		data = data[:end]
+	}
+	for _, line := range bytes.Split(data, []byte("\r\n"))[1:] {
+		i := bytes.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(string(line[:i]), "Host") {
+			continue
+		}
+		host := strings.TrimSpace(string(line[i+1:]))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return host
+	}
+	return ""
+}
+
+// sniffRequest sniff the host of a request for an address, it return the
+// connection to relay and the request to tunnel, unchanged if the host is
+// unknown
+func (s *Service) sniffRequest(conn net.Conn, rawaddr []byte, addr string) (net.Conn, []byte, string) {
+	conn, host := sniffHost(conn)
+	if host == "" || net.ParseIP(host) != nil {
+		return conn, rawaddr, addr
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return conn, rawaddr, addr
+	}
+	hostAddr := net.JoinHostPort(host, port)
+	hostRawaddr, err := ss.RawAddr(hostAddr)
+	if err != nil {
+		return conn, rawaddr, addr
+	}
+	s.debug.Printf("request for %s is for %s\n", addr, hostAddr)
+	if s.accessLog {
+		s.logger.Printf("sniffed %s for %s", host, addr)
+	}
+	return conn, hostRawaddr, hostAddr
+}
+
+// replyOnce return reply calling the wrapped one at most once. The later
+// replies of a request already answered are dropped, a failure then resets
+// conn when closed so the client does not take it for the end of the data.
+func replyOnce(conn net.Conn, reply func(rep byte) error) func(rep byte) error {
+	replied := false
+	return func(rep byte) error {
+		if replied {
+			if tcpConn, ok := conn.(*net.TCPConn); ok && rep != repSucceeded {
+				tcpConn.SetLinger(0)
+			}
+			return nil
+		}
+		replied = true
+		return reply(rep)
+	}
+}
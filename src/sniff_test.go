@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReplyOnceResetsDroppedFailures(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replies := 0
+	reply := replyOnce(conn, func(rep byte) error {
+		replies++
+		return nil
+	})
+	reply(repSucceeded)
+	reply(repNotAllowed)
+	conn.Close()
+	if replies != 1 {
+		t.Fatalf("%d replies sent, want 1", replies)
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [1]byte
+	if _, err := client.Read(buf[:]); !isReset(err) {
+		t.Fatalf("read %v, want the connection reset", err)
+	}
+}
+
+// isReset report whether err is a connection reset by peer
+func isReset(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if syscallErr, ok := err.(*os.SyscallError); ok {
+		err = syscallErr.Err
+	}
+	return err == syscall.ECONNRESET
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// SocketOptions tune the tcp connections of tunnels, on both the client and
+// the server side. The zero value keeps the defaults.
+type SocketOptions struct {
+	// Nagle enable Nagle's algorithm, which favors bulk transfers. Go sets
+	// TCP_NODELAY by default, which suits interactive traffic.
+	Nagle bool
+	// ReadBuffer and WriteBuffer are the socket buffer sizes in bytes, zero
+	// keeps the system default
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+// SetSocketOptions set the options applied to the connections of tunnels
+func (s *Service) SetSocketOptions(options SocketOptions) {
+	s.sockOpts = options
+}
+
+// applySocketOptions apply the socket options to conn if it is a tcp
+// connection, or a shadowsocks connection over tcp
+func (s *Service) applySocketOptions(conn net.Conn) {
+	switch c := conn.(type) {
+	case *ss.Conn:
+		conn = c.Conn
+	case *aeadConn:
+		conn = c.Conn
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if s.sockOpts.Nagle {
+		tcpConn.SetNoDelay(false)
+	}
+	if s.sockOpts.ReadBuffer > 0 {
+		tcpConn.SetReadBuffer(s.sockOpts.ReadBuffer)
+	}
+	if s.sockOpts.WriteBuffer > 0 {
+		tcpConn.SetWriteBuffer(s.sockOpts.WriteBuffer)
+	}
+}
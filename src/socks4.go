@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+
+	socks4MaxField = 255 // longest user id or domain accepted
+)
+
+var errSocks4Field = errors.New("socks4 field too long")
+
+// handleSocks4 serve a socks4 or socks4a client whose version byte was
+// already read. Only CONNECT is supported, and only without socks5
+// authentication since socks4 has no password.
+func (s *Service) handleSocks4(conn net.Conn) {
+	remoteAddr := conn.RemoteAddr().String()
+	cmd, rawaddr, addr, err := s.getSocks4Request(conn)
+	if err == nil && (cmd != socksCmdConnect || !s.commandEnabled(cmd)) {
+		err = ErrCmd
+	}
+	if err == nil && s.username != "" {
+		err = ErrNoAcceptableMethod
+	}
+	if err != nil {
+		s.debug.Println("error getting socks4 request:", err)
+		if _, ok := err.(*SocksError); ok {
+			conn.Write(socks4Reply(socks4Rejected))
+		}
+		s.handshakeFailed(conn.RemoteAddr(), err)
+		s.publish(ConnEvent{Type: ConnHandshakeFailed, Remote: remoteAddr, Err: err})
+		return
+	}
+	s.tunnelRequest(conn, rawaddr, addr, func(rep byte) error {
+		code := byte(socks4Granted)
+		if rep != repSucceeded {
+			code = socks4Rejected
+		}
+		_, err := conn.Write(socks4Reply(code))
+		return err
+	})
+}
+
+// getSocks4Request read the rest of a socks4 request and translate the
+// destination into a shadowsocks raw address. A 0.0.0.x address with x not
+// zero means a socks4a domain follows the user id.
+func (s *Service) getSocks4Request(conn net.Conn) (cmd byte, rawaddr []byte, host string, err error) {
+	// CD(1) DSTPORT(2) DSTIP(4)
+	var buf [7]byte
+	if _, err = io.ReadFull(conn, buf[:]); err != nil {
+		return
+	}
+	cmd = buf[0]
+	port := buf[1:3]
+	ip := net.IP(buf[3:7])
+	if _, err = readNulString(conn); err != nil { // user id, ignored
+		return
+	}
+
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		var domain string
+		if domain, err = readNulString(conn); err != nil {
+			return
+		}
+		if domain == "" {
+			err = ErrDomainLen
+			return
+		}
+		rawaddr = append([]byte{typeDm, byte(len(domain))}, domain...)
+		host = domain
+	} else {
+		rawaddr = append([]byte{typeIPv4}, ip...)
+		host = ip.String()
+	}
+	rawaddr = append(rawaddr, port...)
+	host = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	return
+}
+
+// readNulString read a nul terminated string of at most socks4MaxField bytes
+func readNulString(r io.Reader) (string, error) {
+	var buf [socks4MaxField + 1]byte
+	for i := range buf {
+		if _, err := io.ReadFull(r, buf[i:i+1]); err != nil {
+			return "", err
+		}
+		if buf[i] == 0 {
+			return string(buf[:i]), nil
+		}
+	}
+	return "", errSocks4Field
+}
+
+// socks4Reply return a socks4 reply with code, the address is ignored by
+// clients of CONNECT
+func socks4Reply(code byte) []byte {
+	return []byte{0, code, 0, 0, 0, 0, 0, 0}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGetSocks4Request(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     []byte
+		rawaddr []byte
+		host    string
+	}{
+		{
+			name:    "socks4",
+			req:     []byte{socksCmdConnect, 0, 80, 10, 0, 0, 1, 'u', 0},
+			rawaddr: []byte{typeIPv4, 10, 0, 0, 1, 0, 80},
+			host:    "10.0.0.1:80",
+		},
+		{
+			name:    "socks4a",
+			req:     append([]byte{socksCmdConnect, 1, 187, 0, 0, 0, 1, 0}, "example.com\x00"...),
+			rawaddr: append(append([]byte{typeDm, 11}, "example.com"...), 1, 187),
+			host:    "example.com:443",
+		},
+	}
+	s := NewService(&ServerCipher{server: "server.test:8388"})
+	for _, tt := range tests {
+		conn := &bufferConn{Buffer: bytes.NewBuffer(tt.req)}
+		cmd, rawaddr, host, err := s.getSocks4Request(conn)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if cmd != socksCmdConnect || !bytes.Equal(rawaddr, tt.rawaddr) || host != tt.host {
+			t.Errorf("%s: got %d %v %q", tt.name, cmd, rawaddr, host)
+		}
+	}
+
+	// socks4a without a domain
+	conn := &bufferConn{Buffer: bytes.NewBuffer([]byte{socksCmdConnect, 0, 80, 0, 0, 0, 1, 0, 0})}
+	if _, _, _, err := s.getSocks4Request(conn); err != ErrDomainLen {
+		t.Errorf("empty socks4a domain: %v", err)
+	}
+}
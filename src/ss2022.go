@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/blake3"
+)
+
+// Constants of the Shadowsocks 2022 edition, see SIP022
+const (
+	ss2022SubkeyContext = "shadowsocks 2022 session subkey"
+	ss2022TypeClient    = 0
+	ss2022TypeServer    = 1
+	ss2022MaxTimeDiff   = 30 * time.Second
+	ss2022MaxPayload    = 0xffff
+	ss2022MaxPadding    = 900
+	ss2022SaltTTL       = 60 * time.Second
+	ss2022ReplayWindow  = 64 // packet ids accepted out of order
+)
+
+var (
+	errSS2022Replay   = errors.New("ss2022: replayed salt")
+	errSS2022Header   = errors.New("ss2022: invalid header")
+	errSS2022Time     = errors.New("ss2022: timestamp out of range")
+	errSS2022Session  = errors.New("ss2022: unexpected session")
+	errSS2022NoWrite  = errors.New("ss2022: response before request")
+	errSS2022ShortUDP = errors.New("ss2022: packet too short")
+)
+
+// ss2022Cipher is a cipher of the Shadowsocks 2022 edition. The password is
+// the base64 of the pre-shared key, whose length is fixed by the method.
+// It only acts as a client.
+type ss2022Cipher struct {
+	psk     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	block   cipher.Block // encrypts the udp headers, nil with chacha20
+	salts   *saltPool
+}
+
+// newSS2022Cipher return the cipher of a 2022 method, nil without error if
+// method is not one
+func newSS2022Cipher(method, password string) (*ss2022Cipher, error) {
+	var keySize int
+	var newAEAD func(key []byte) (cipher.AEAD, error)
+	switch method {
+	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
+		keySize = 16
+		if method == "2022-blake3-aes-256-gcm" {
+			keySize = 32
+		}
+		newAEAD = func(key []byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		}
+	case "2022-blake3-chacha20-poly1305":
+		keySize, newAEAD = chacha20poly1305.KeySize, chacha20poly1305.New
+	default:
+		return nil, nil
+	}
+
+	psk, err := base64.StdEncoding.DecodeString(password)
+	if err != nil {
+		return nil, fmt.Errorf("password must be a base64 key: %v", err)
+	}
+	if len(psk) != keySize {
+		return nil, fmt.Errorf("password must be a base64 key of %d bytes, got %d", keySize, len(psk))
+	}
+	c := &ss2022Cipher{psk: psk, newAEAD: newAEAD, salts: newSaltPool()}
+	if method != "2022-blake3-chacha20-poly1305" {
+		if c.block, err = aes.NewCipher(psk); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// subkey return the aead of a session identified by material, the salt of a
+// tcp stream or the session id of udp packets
+func (c *ss2022Cipher) subkey(material []byte) (cipher.AEAD, error) {
+	key := make([]byte, len(c.psk))
+	blake3.DeriveKey(key, ss2022SubkeyContext, append(append([]byte{}, c.psk...), material...))
+	return c.newAEAD(key)
+}
+
+func (c *ss2022Cipher) StreamConn(conn net.Conn) net.Conn {
+	return &ss2022Conn{Conn: conn, cipher: c}
+}
+
+func (c *ss2022Cipher) PacketConn(pc net.PacketConn) net.PacketConn {
+	conn := &ss2022PacketConn{PacketConn: pc, cipher: c}
+	rand.Read(conn.session[:])
+	return conn
+}
+
+// saltPool remember the salts received lately to reject replays
+type saltPool struct {
+	mu    sync.Mutex
+	salts map[string]time.Time
+}
+
+func newSaltPool() *saltPool {
+	return &saltPool{salts: make(map[string]time.Time)}
+}
+
+// add record salt, it report false if salt was already seen
+func (p *saltPool) add(salt []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for s, t := range p.salts {
+		if now.Sub(t) > ss2022SaltTTL {
+			delete(p.salts, s)
+		}
+	}
+	if _, ok := p.salts[string(salt)]; ok {
+		return false
+	}
+	p.salts[string(salt)] = now
+	return true
+}
+
+// checkTimestamp verify a timestamp is close enough to the local clock
+func checkTimestamp(b []byte) error {
+	t := time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	if d := time.Since(t); d > ss2022MaxTimeDiff || d < -ss2022MaxTimeDiff {
+		return errSS2022Time
+	}
+	return nil
+}
+
+// randomPadding return between 1 and ss2022MaxPadding zero bytes
+func randomPadding() []byte {
+	var n [2]byte
+	rand.Read(n[:])
+	return make([]byte, 1+int(binary.BigEndian.Uint16(n[:]))%ss2022MaxPadding)
+}
+
+// ss2022Conn is the client side of a 2022 tcp stream. The first write must
+// be the target address, as sendRequest does, it is sent in the request
+// header with padding.
+type ss2022Conn struct {
+	net.Conn
+	cipher *ss2022Cipher
+
+	enc      cipher.AEAD
+	encNonce []byte
+	reqSalt  []byte
+
+	dec      cipher.AEAD
+	decNonce []byte
+	decBuf   []byte
+	leftover []byte
+
+	// reads failing in the middle of the response headers or a chunk, e.g.
+	// on a read deadline, leave what they read for the next read to resume
+	respSalt  []byte
+	partial   int
+	gotHeader bool
+	size      int
+	haveSize  bool
+}
+
+func (c *ss2022Conn) seal(dst, b []byte) []byte {
+	dst = c.enc.Seal(dst, c.encNonce, b, nil)
+	increment(c.encNonce)
+	return dst
+}
+
+func (c *ss2022Conn) open(b []byte) ([]byte, error) {
+	b, err := c.dec.Open(b[:0], c.decNonce, b, nil)
+	increment(c.decNonce)
+	return b, err
+}
+
+func (c *ss2022Conn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if c.enc == nil {
+		return c.writeRequest(b)
+	}
+	written := 0
+	buf := make([]byte, 0, 2+aeadTagSize+ss2022MaxPayload+aeadTagSize)
+	for len(b) > 0 {
+		n := len(b)
+		if n > ss2022MaxPayload {
+			n = ss2022MaxPayload
+		}
+		var size [2]byte
+		binary.BigEndian.PutUint16(size[:], uint16(n))
+		buf = c.seal(buf[:0], size[:])
+		buf = c.seal(buf, b[:n])
+		if _, err := c.Conn.Write(buf); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// writeRequest send the salt, the fixed length header and the variable
+// length header holding the address addr
+func (c *ss2022Conn) writeRequest(addr []byte) (int, error) {
+	salt := make([]byte, len(c.cipher.psk))
+	if _, err := rand.Read(salt); err != nil {
+		return 0, err
+	}
+	enc, err := c.cipher.subkey(salt)
+	if err != nil {
+		return 0, err
+	}
+	c.enc, c.encNonce, c.reqSalt = enc, make([]byte, enc.NonceSize()), salt
+
+	padding := randomPadding()
+	variable := make([]byte, 0, len(addr)+2+len(padding))
+	variable = append(variable, addr...)
+	variable = append(variable, byte(len(padding)>>8), byte(len(padding)))
+	variable = append(variable, padding...)
+
+	fixed := make([]byte, 1+8+2)
+	fixed[0] = ss2022TypeClient
+	binary.BigEndian.PutUint64(fixed[1:], uint64(time.Now().Unix()))
+	binary.BigEndian.PutUint16(fixed[9:], uint16(len(variable)))
+
+	buf := append([]byte{}, salt...)
+	buf = c.seal(buf, fixed)
+	buf = c.seal(buf, variable)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(addr), nil
+}
+
+func (c *ss2022Conn) Read(b []byte) (int, error) {
+	if len(c.leftover) > 0 {
+		n := copy(b, c.leftover)
+		c.leftover = c.leftover[n:]
+		return n, nil
+	}
+	if !c.gotHeader {
+		if err := c.readResponse(); err != nil {
+			return 0, err
+		}
+	} else if !c.haveSize {
+		size := c.decBuf[:2+aeadTagSize]
+		if err := c.readFull(size); err != nil {
+			return 0, err
+		}
+		size, err := c.open(size)
+		if err != nil {
+			return 0, err
+		}
+		c.size, c.haveSize = int(binary.BigEndian.Uint16(size)), true
+	}
+
+	buf := c.decBuf[:c.size+aeadTagSize]
+	if err := c.readFull(buf); err != nil {
+		return 0, err
+	}
+	c.haveSize = false
+	payload, err := c.open(buf)
+	if err != nil {
+		return 0, err
+	}
+	copied := copy(b, payload)
+	c.leftover = payload[copied:]
+	return copied, nil
+}
+
+// readFull fill buf from the connection, resuming after the bytes read into
+// it by a previous call which failed
+func (c *ss2022Conn) readFull(buf []byte) error {
+	n, err := io.ReadFull(c.Conn, buf[c.partial:])
+	c.partial += n
+	if err != nil {
+		return err
+	}
+	c.partial = 0
+	return nil
+}
+
+// readResponse read and check the salt and the fixed length header of the
+// response, which gives the length of the first chunk
+func (c *ss2022Conn) readResponse() error {
+	if c.reqSalt == nil {
+		return errSS2022NoWrite
+	}
+	saltSize := len(c.cipher.psk)
+	if c.dec == nil {
+		if c.respSalt == nil {
+			c.respSalt = make([]byte, saltSize)
+		}
+		if err := c.readFull(c.respSalt); err != nil {
+			return err
+		}
+		if !c.cipher.salts.add(c.respSalt) {
+			return errSS2022Replay
+		}
+		dec, err := c.cipher.subkey(c.respSalt)
+		if err != nil {
+			return err
+		}
+		c.dec, c.decNonce = dec, make([]byte, dec.NonceSize())
+		c.decBuf = make([]byte, ss2022MaxPayload+aeadTagSize)
+	}
+
+	header := c.decBuf[:1+8+saltSize+2+aeadTagSize]
+	if err := c.readFull(header); err != nil {
+		return err
+	}
+	header, err := c.open(header)
+	if err != nil {
+		return err
+	}
+	if header[0] != ss2022TypeServer {
+		return errSS2022Header
+	}
+	if err := checkTimestamp(header[1:9]); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[9:9+saltSize], c.reqSalt) {
+		return errSS2022Header
+	}
+	c.gotHeader = true
+	c.size, c.haveSize = int(binary.BigEndian.Uint16(header[9+saltSize:])), true
+	return nil
+}
+
+// ss2022PacketConn is the client side of a 2022 udp session
+type ss2022PacketConn struct {
+	net.PacketConn
+	cipher *ss2022Cipher
+
+	mu       sync.Mutex
+	session  [8]byte
+	packetID uint64
+	enc      cipher.AEAD
+
+	// the current and the previous sessions of the server, packets of the
+	// previous one may still arrive after the server moved on
+	decMu      sync.Mutex
+	server     *ss2022Session
+	prevServer *ss2022Session
+}
+
+// ss2022Session is a udp session of the server, with the packet ids
+// received in it
+type ss2022Session struct {
+	id     []byte
+	dec    cipher.AEAD // nil with chacha20, whose packets carry their nonce
+	window packetWindow
+}
+
+// packetWindow reject the packet ids already received or older than the
+// ss2022ReplayWindow last ones, like the anti-replay window of IPsec
+type packetWindow struct {
+	top  uint64 // highest id received
+	seen uint64 // bit i is set if top-i was received
+}
+
+// accept record id, it report false if id is a replay or too old
+func (w *packetWindow) accept(id uint64) bool {
+	switch {
+	case w.seen == 0:
+		w.top, w.seen = id, 1
+	case id > w.top:
+		if shift := id - w.top; shift < ss2022ReplayWindow {
+			w.seen = w.seen<<shift | 1
+		} else {
+			w.seen = 1
+		}
+		w.top = id
+	case w.top-id >= ss2022ReplayWindow:
+		return false
+	default:
+		bit := uint64(1) << (w.top - id)
+		if w.seen&bit != 0 {
+			return false
+		}
+		w.seen |= bit
+	}
+	return true
+}
+
+func (c *ss2022PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var header [16]byte
+	copy(header[:8], c.session[:])
+	binary.BigEndian.PutUint64(header[8:], c.packetID)
+	c.packetID++
+
+	body := make([]byte, 0, 16+1+8+2+len(b))
+	if c.cipher.block == nil {
+		body = append(body, header[:]...)
+	}
+	body = append(body, ss2022TypeClient)
+	body = binary.BigEndian.AppendUint64(body, uint64(time.Now().Unix()))
+	body = append(body, 0, 0) // no padding
+	body = append(body, b...)
+
+	var packet []byte
+	if c.cipher.block == nil {
+		aead, err := chacha20poly1305.NewX(c.cipher.psk)
+		if err != nil {
+			return 0, err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		rand.Read(nonce)
+		packet = aead.Seal(nonce, nonce, body, nil)
+	} else {
+		if c.enc == nil {
+			enc, err := c.cipher.subkey(c.session[:])
+			if err != nil {
+				return 0, err
+			}
+			c.enc = enc
+		}
+		packet = make([]byte, 16, 16+len(body)+aeadTagSize)
+		c.cipher.block.Encrypt(packet, header[:])
+		packet = c.enc.Seal(packet, header[4:16], body, nil)
+	}
+	if _, err := c.PacketConn.WriteTo(packet, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *ss2022PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+	body, err := c.openPacket(b[:n])
+	if err != nil {
+		return 0, addr, err
+	}
+	// type, timestamp, client session id, padding length
+	if len(body) < 1+8+8+2 || body[0] != ss2022TypeServer {
+		return 0, addr, errSS2022Header
+	}
+	if err := checkTimestamp(body[1:9]); err != nil {
+		return 0, addr, err
+	}
+	if !bytes.Equal(body[9:17], c.session[:]) {
+		return 0, addr, errSS2022Session
+	}
+	padding := int(binary.BigEndian.Uint16(body[17:19]))
+	if len(body) < 19+padding {
+		return 0, addr, errSS2022Header
+	}
+	return copy(b, body[19+padding:]), addr, nil
+}
+
+// openPacket decrypt a packet from the server and reject replays, it
+// return the body after the session and packet ids
+func (c *ss2022PacketConn) openPacket(packet []byte) ([]byte, error) {
+	c.decMu.Lock()
+	defer c.decMu.Unlock()
+	var session *ss2022Session
+	var body []byte
+	var packetID uint64
+	if c.cipher.block == nil {
+		aead, err := chacha20poly1305.NewX(c.cipher.psk)
+		if err != nil {
+			return nil, err
+		}
+		if len(packet) < aead.NonceSize()+16+aeadTagSize {
+			return nil, errSS2022ShortUDP
+		}
+		nonce, sealed := packet[:aead.NonceSize()], packet[aead.NonceSize():]
+		if body, err = aead.Open(sealed[:0], nonce, sealed, nil); err != nil {
+			return nil, err
+		}
+		session = c.serverSession(body[:8])
+		packetID, body = binary.BigEndian.Uint64(body[8:16]), body[16:]
+	} else {
+		if len(packet) < 16+aeadTagSize {
+			return nil, errSS2022ShortUDP
+		}
+		var header [16]byte
+		c.cipher.block.Decrypt(header[:], packet[:16])
+		session = c.serverSession(header[:8])
+		if session.dec == nil {
+			dec, err := c.cipher.subkey(session.id)
+			if err != nil {
+				return nil, err
+			}
+			session.dec = dec
+		}
+		sealed := packet[16:]
+		var err error
+		if body, err = session.dec.Open(sealed[:0], header[4:16], sealed, nil); err != nil {
+			return nil, err
+		}
+		packetID = binary.BigEndian.Uint64(header[8:])
+	}
+
+	if !session.window.accept(packetID) {
+		return nil, errSS2022Replay
+	}
+	if session != c.server && session != c.prevServer {
+		c.prevServer, c.server = c.server, session
+	}
+	return body, nil
+}
+
+// serverSession return the known session of the server with id, or a new
+// one which the caller installs once a packet of it is authenticated
+func (c *ss2022PacketConn) serverSession(id []byte) *ss2022Session {
+	for _, session := range []*ss2022Session{c.server, c.prevServer} {
+		if session != nil && bytes.Equal(session.id, id) {
+			return session
+		}
+	}
+	return &ss2022Session{id: append([]byte{}, id...)}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestSS2022Cipher return a 2022 cipher with a random key
+func newTestSS2022Cipher(t *testing.T, method string, keySize int) *ss2022Cipher {
+	psk := make([]byte, keySize)
+	rand.Read(psk)
+	c, err := newSS2022Cipher(method, base64.StdEncoding.EncodeToString(psk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSS2022Stream(t *testing.T) {
+	c := newTestSS2022Cipher(t, "2022-blake3-aes-256-gcm", 32)
+	var request bytes.Buffer
+	client := c.StreamConn(&bufferConn{Buffer: &request})
+	target := []byte{typeIPv4, 127, 0, 0, 1, 0, 80}
+	if _, err := client.Write(target); err != nil {
+		t.Fatal(err)
+	}
+
+	// decode the request like a server
+	reqSalt := request.Next(32)
+	dec, _ := c.subkey(reqSalt)
+	nonce := make([]byte, dec.NonceSize())
+	fixed, err := dec.Open(nil, nonce, request.Next(1+8+2+aeadTagSize), nil)
+	if err != nil || fixed[0] != ss2022TypeClient {
+		t.Fatalf("fixed header %v, %v", fixed, err)
+	}
+	increment(nonce)
+	variable, err := dec.Open(nil, nonce, request.Next(int(binary.BigEndian.Uint16(fixed[9:]))+aeadTagSize), nil)
+	if err != nil || !bytes.HasPrefix(variable, target) {
+		t.Fatalf("variable header %v, %v", variable, err)
+	}
+
+	// answer with two chunks
+	respSalt := make([]byte, 32)
+	rand.Read(respSalt)
+	enc, _ := c.subkey(respSalt)
+	nonce = make([]byte, enc.NonceSize())
+	seal := func(dst, b []byte) []byte {
+		dst = enc.Seal(dst, nonce, b, nil)
+		increment(nonce)
+		return dst
+	}
+	header := []byte{ss2022TypeServer}
+	header = binary.BigEndian.AppendUint64(header, uint64(time.Now().Unix()))
+	header = append(header, reqSalt...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len("first")))
+	response := seal(append([]byte{}, respSalt...), header)
+	response = seal(response, []byte("first"))
+	response = seal(response, []byte{0, byte(len("second"))})
+	response = seal(response, []byte("second"))
+
+	a, b := net.Pipe()
+	defer b.Close()
+	client.(*ss2022Conn).Conn = a
+	// cut the response in the salt, the header, the payload and a length
+	cuts := [][]byte{response[:20], response[20:50], response[50:90], response[90:100], response[100:]}
+	var plain []byte
+	for _, cut := range cuts {
+		go b.Write(cut)
+		client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		buf := make([]byte, 64)
+		n, err := client.Read(buf)
+		if err != nil && !isTimeout(err) {
+			t.Fatal(err)
+		}
+		plain = append(plain, buf[:n]...)
+	}
+	buf := make([]byte, 64)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain = append(plain, buf[:n]...); string(plain) != "firstsecond" {
+		t.Fatalf("read %q across timeouts", plain)
+	}
+}
+
+// udpPair return two connected loopback udp sockets
+func udpPair(t *testing.T) (*net.UDPConn, *net.UDPConn) {
+	a, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := net.DialUDP("udp", nil, a.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+// serverPacket seal payload like a server in session for client with id
+func serverPacket(t *testing.T, c *ss2022Cipher, session []byte, id uint64, client []byte, payload string) []byte {
+	var header [16]byte
+	copy(header[:8], session)
+	binary.BigEndian.PutUint64(header[8:], id)
+	body := []byte{ss2022TypeServer}
+	body = binary.BigEndian.AppendUint64(body, uint64(time.Now().Unix()))
+	body = append(body, client...)
+	body = append(body, 0, 0)
+	body = append(body, payload...)
+	enc, err := c.subkey(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := make([]byte, 16)
+	c.block.Encrypt(packet, header[:])
+	return enc.Seal(packet, header[4:16], body, nil)
+}
+
+func TestSS2022Packets(t *testing.T) {
+	c := newTestSS2022Cipher(t, "2022-blake3-aes-128-gcm", 16)
+	a, b := udpPair(t)
+	defer a.Close()
+	defer b.Close()
+	client := c.PacketConn(a).(*ss2022PacketConn)
+
+	// the request is sealed with the session of the client
+	if _, err := client.WriteTo([]byte("query"), b.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	packet := make([]byte, 1500)
+	n, err := b.Read(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header [16]byte
+	c.block.Decrypt(header[:], packet[:16])
+	dec, _ := c.subkey(header[:8])
+	body, err := dec.Open(nil, header[4:16], packet[16:n], nil)
+	if err != nil || body[0] != ss2022TypeClient || !bytes.HasSuffix(body, []byte("query")) {
+		t.Fatalf("request %v, %v", body, err)
+	}
+
+	session := []byte("server00")
+	tests := []struct {
+		id   uint64
+		want error
+	}{
+		{10, nil},
+		{10, errSS2022Replay},
+		{8, nil},
+		{100, nil},
+		{9, errSS2022Replay}, // out of the window
+		{99, nil},
+	}
+	buf := make([]byte, 1500)
+	for _, test := range tests {
+		b.Write(serverPacket(t, c, session, test.id, client.session[:], "answer"))
+		a.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := client.ReadFrom(buf)
+		if err != test.want {
+			t.Fatalf("packet %d: %v, want %v", test.id, err, test.want)
+		}
+		if err == nil && string(buf[:n]) != "answer" {
+			t.Fatalf("packet %d: %q", test.id, buf[:n])
+		}
+	}
+	// a new session of the server starts its own window
+	b.Write(serverPacket(t, c, []byte("server01"), 10, client.session[:], "answer"))
+	if _, _, err := client.ReadFrom(buf); err != nil {
+		t.Fatalf("new session: %v", err)
+	}
+}
+
+func TestSS2022RequestNotReadable(t *testing.T) {
+	c := newTestSS2022Cipher(t, "2022-blake3-chacha20-poly1305", 32)
+	a, b := net.Pipe()
+	defer b.Close()
+	if _, err := io.ReadFull(c.StreamConn(a), make([]byte, 1)); err != errSS2022NoWrite {
+		t.Fatalf("read before the request: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// NewServerCipherFromURL return the server of an ss:// url, in the SIP002
+// form ss://userinfo@host:port/?plugin=name;opts#tag, where userinfo is
+// method:password encoded with base64url or percent encoded, or in the
+// legacy form ss://base64(method:password@host:port)#tag
+func NewServerCipherFromURL(rawurl string) (*ServerCipher, error) {
+	const scheme = "ss://"
+	if !strings.HasPrefix(rawurl, scheme) {
+		return nil, errors.New("ss url: missing ss:// scheme")
+	}
+	rest := strings.TrimPrefix(rawurl, scheme)
+	if i := strings.IndexByte(rest, '#'); i >= 0 {
+		rest = rest[:i] // the tag only names the server
+	}
+
+	var method, password, server, plugin string
+	if strings.Contains(rest, "@") {
+		u, err := url.Parse(scheme + rest)
+		if err != nil {
+			return nil, fmt.Errorf("ss url: %v", err)
+		}
+		if p, ok := u.User.Password(); ok {
+			method, password = u.User.Username(), p
+		} else {
+			userinfo, err := decodeBase64(u.User.Username())
+			if err != nil {
+				return nil, fmt.Errorf("ss url: userinfo: %v", err)
+			}
+			method, password = splitPair(userinfo, ':')
+		}
+		server = u.Host
+		plugin = u.Query().Get("plugin")
+	} else {
+		decoded, err := decodeBase64(rest)
+		if err != nil {
+			return nil, fmt.Errorf("ss url: %v", err)
+		}
+		i := strings.LastIndexByte(decoded, '@')
+		if i < 0 {
+			return nil, errors.New("ss url: missing server")
+		}
+		method, password = splitPair(decoded[:i], ':')
+		server = decoded[i+1:]
+	}
+
+	if method == "" || password == "" {
+		return nil, errors.New("ss url: missing method or password")
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return nil, fmt.Errorf("ss url: %v", err)
+	}
+	serverCipher, err := NewServerCipher(server, strings.ToLower(method), password)
+	if err != nil {
+		return nil, err
+	}
+	if plugin != "" {
+		serverCipher.SetPlugin(splitPair(plugin, ';'))
+	}
+	return serverCipher, nil
+}
+
+// decodeBase64 decode s with the standard or url alphabet, padded or not
+func decodeBase64(s string) (string, error) {
+	s = strings.TrimRight(s, "=")
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		b, err = base64.RawStdEncoding.DecodeString(s)
+	}
+	return string(b), err
+}
+
+// splitPair split s at the first sep, the second part is empty without it
+func splitPair(s string, sep byte) (string, string) {
+	if i := strings.IndexByte(s, sep); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestNewServerCipherFromURL(t *testing.T) {
+	tests := []struct {
+		url, server, plugin, pluginOpts string
+	}{
+		// SIP002, userinfo in base64url without padding
+		{"ss://YWVzLTI1Ni1nY206c2VjcmV0@server.test:8388/?plugin=obfs-local%3Bobfs%3Dhttp#tag",
+			"server.test:8388", "obfs-local", "obfs=http"},
+		// SIP002, userinfo percent encoded
+		{"ss://aes-256-gcm:s%40cret@[2001:db8::1]:8388", "[2001:db8::1]:8388", "", ""},
+		// legacy, everything in base64
+		{"ss://YWVzLTI1Ni1nY206c2VjcmV0QHNlcnZlci50ZXN0Ojg0MDA=#tag", "server.test:8400", "", ""},
+	}
+	for _, tt := range tests {
+		sc, err := NewServerCipherFromURL(tt.url)
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if sc.server != tt.server || sc.plugin != tt.plugin || sc.pluginOpts != tt.pluginOpts {
+			t.Errorf("%s: server %q, plugin %q %q", tt.url, sc.server, sc.plugin, sc.pluginOpts)
+		}
+	}
+
+	for _, url := range []string{
+		"http://server.test:8388",
+		"ss://YWVzLTI1Ni1nY20@server.test:8388",     // no password
+		"ss://YWVzLTI1Ni1nY206c2VjcmV0@server.test", // no port
+		"ss://YWVzLTI1Ni1nY206c2VjcmV0",             // legacy without server
+	} {
+		if _, err := NewServerCipherFromURL(url); err == nil {
+			t.Errorf("%s accepted", url)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// subscriptionTimeout is how long fetching a subscription may take
+const subscriptionTimeout = 30 * time.Second
+
+// sip008 is an online configuration document, see SIP008
+type sip008 struct {
+	Version int            `json:"version"`
+	Servers []sip008Server `json:"servers"`
+}
+
+// sip008Server is a server of a SIP008 document, with the udp over tcp flag
+// of some providers
+type sip008Server struct {
+	ServerConfig
+	UDPOverTCP bool `json:"udp_over_tcp"`
+}
+
+// Subscribe fetch the SIP008 online configuration at url now and every
+// interval until the service stops. The servers it lists are used after the
+// servers set by ReloadServers, which leaves them alone, each refresh
+// replacing the previous list of url. A failed refresh keeps the servers in
+// use. Plugins of the servers are kept, servers relaying udp over tcp only
+// get the tcp tunnels since udp is relayed in udp packets. The servers are
+// balanced with round robin unless a balancer is set.
+func (s *Service) Subscribe(url string, interval time.Duration) {
+	if s.balancer == nil {
+		s.SetLoadBalancer(NewRoundRobinBalancer())
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			servers, err := fetchSubscription(url)
+			if err != nil {
+				s.logger.Printf("subscription %s: %v", url, err)
+			} else {
+				s.setSubscription(url, servers)
+				s.debug.Printf("subscription %s: %d servers\n", url, len(servers))
+			}
+			select {
+			case <-s.ch:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// setSubscription replace the servers of the subscription at url
+func (s *Service) setSubscription(url string, servers []*ServerCipher) {
+	s.serversMu.Lock()
+	if s.subscribed == nil {
+		s.subscribed = make(map[string][]*ServerCipher)
+	}
+	s.subscribed[url] = servers
+	old, list := s.setServers()
+	s.serversMu.Unlock()
+	handOverPlugins(old, list)
+	stopPlugins(old, list)
+}
+
+// fetchSubscription return the servers of the SIP008 document at url,
+// servers which can't be used are skipped
+func fetchSubscription(url string) ([]*ServerCipher, error) {
+	client := &http.Client{Timeout: subscriptionTimeout}
+	res, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	doc := &sip008{}
+	if err := json.NewDecoder(res.Body).Decode(doc); err != nil {
+		return nil, err
+	}
+	if doc.Version != 1 {
+		return nil, fmt.Errorf("unsupported version %d", doc.Version)
+	}
+
+	servers := make([]*ServerCipher, 0, len(doc.Servers))
+	for _, server := range doc.Servers {
+		config := &Config{Servers: []ServerConfig{server.ServerConfig}}
+		list, err := config.ServerCiphers()
+		if err != nil {
+			logger.Printf("subscription server %s: %v", server.Remarks, err)
+			continue
+		}
+		for _, sc := range list {
+			sc.tcpOnly = server.UDPOverTCP
+		}
+		servers = append(servers, list...)
+	}
+	if len(servers) == 0 {
+		return nil, errNoServer
+	}
+	return servers, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionKeepsReloadedServers(t *testing.T) {
+	doc := `{"version": 1, "servers": [
+		{"server": "a.test", "server_port": 8388, "method": "aes-256-gcm", "password": "a"},
+		{"server": "b.test", "server_port": 8388, "method": "aes-256-gcm", "password": "b", "udp_over_tcp": true}
+	]}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, doc)
+	}))
+	defer ts.Close()
+
+	servers, err := fetchSubscription(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 2 || servers[0].tcpOnly || !servers[1].tcpOnly {
+		t.Fatalf("subscribed to %d servers, want a.test and b.test for tcp only", len(servers))
+	}
+
+	static, err := NewServerCipher("static.test:8388", "aes-256-gcm", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(static)
+	s.setSubscription(ts.URL, servers)
+	reloaded, _ := NewServerCipher("reloaded.test:8388", "aes-256-gcm", "reloaded")
+	s.ReloadServers([]*ServerCipher{reloaded})
+
+	var got []string
+	for _, sc := range s.servers {
+		got = append(got, sc.server)
+	}
+	if len(got) != 3 || got[0] != "reloaded.test:8388" || got[1] != "a.test:8388" || got[2] != "b.test:8388" {
+		t.Fatalf("servers %v after a reload", got)
+	}
+}
+
+func TestSubscriptionBalancesAndSkipsTCPOnlyForUDP(t *testing.T) {
+	static, _ := NewServerCipher("static.test:8388", "aes-256-gcm", "static")
+	s := NewService(static)
+	defer s.Stop()
+	// nothing to fetch, the servers are set below
+	s.Subscribe("http://127.0.0.1:1/", time.Hour)
+	tcpOnly, _ := NewServerCipher("uot.test:8388", "aes-256-gcm", "uot")
+	tcpOnly.tcpOnly = true
+	s.setSubscription("http://127.0.0.1:1/", []*ServerCipher{tcpOnly})
+
+	picked := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		picked[s.pickServer(PickRequest{}).server] = true
+	}
+	if len(picked) != 2 {
+		t.Errorf("picked %v for tcp, want both servers", picked)
+	}
+	for i := 0; i < 2; i++ {
+		if got := s.pickServer(PickRequest{UDP: true}); got != static {
+			t.Fatalf("picked %s for udp, want static.test", got.server)
+		}
+	}
+	s.ReloadServers([]*ServerCipher{tcpOnly})
+	if got := s.pickServer(PickRequest{UDP: true}); got != nil {
+		t.Errorf("picked %s for udp, want none", got.server)
+	}
+}
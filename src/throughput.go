@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	throughputInterval = time.Second
+	throughputWindow   = 5 // samples
+)
+
+// throughputMeter estimate the current traffic rate from the cumulative
+// totals, sampled on a ticker over a short sliding window
+type throughputMeter struct {
+	mu       sync.Mutex
+	samples  []throughputSample
+	sent     float64
+	received float64
+}
+
+type throughputSample struct {
+	at    time.Time
+	stats TrafficStats
+}
+
+// add record stats taken at t and update the rates over the window
+func (m *throughputMeter) add(t time.Time, stats TrafficStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = append(m.samples, throughputSample{t, stats})
+	if len(m.samples) > throughputWindow+1 {
+		m.samples = m.samples[1:]
+	}
+	first := m.samples[0]
+	elapsed := t.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	m.sent = float64(stats.Sent-first.stats.Sent) / elapsed
+	m.received = float64(stats.Received-first.stats.Received) / elapsed
+}
+
+func (m *throughputMeter) rates() (sent, received float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sent, m.received
+}
+
+// sampleThroughput feed the meter until the service stops. It is started
+// with the service, so it keeps the wall clock of its ticker instead of
+// reading s.now, which setClock may replace.
+func (s *Service) sampleThroughput() {
+	ticker := time.NewTicker(throughputInterval)
+	defer ticker.Stop()
+	s.throughput.add(time.Now(), s.Stats())
+	for {
+		select {
+		case <-s.ch:
+			return
+		case now := <-ticker.C:
+			s.throughput.add(now, s.Stats())
+		}
+	}
+}
+
+// Throughput return the bytes per second sent and received over the last
+// few seconds
+func (s *Service) Throughput() (sent, received float64) {
+	return s.throughput.rates()
+}
+
+// MetricsHandler return a http handler exporting the traffic totals and the
+// current throughput in the prometheus text format
+func (s *Service) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := s.Stats()
+		sent, received := s.Throughput()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintln(w, "# HELP shadowsocks_bytes_total Bytes relayed since the service started.")
+		fmt.Fprintln(w, "# TYPE shadowsocks_bytes_total counter")
+		fmt.Fprintf(w, "shadowsocks_bytes_total{direction=\"sent\"} %d\n", stats.Sent)
+		fmt.Fprintf(w, "shadowsocks_bytes_total{direction=\"received\"} %d\n", stats.Received)
+		fmt.Fprintln(w, "# HELP shadowsocks_throughput_bytes Bytes per second relayed over the last few seconds.")
+		fmt.Fprintln(w, "# TYPE shadowsocks_throughput_bytes gauge")
+		fmt.Fprintf(w, "shadowsocks_throughput_bytes{direction=\"sent\"} %g\n", sent)
+		fmt.Fprintf(w, "shadowsocks_throughput_bytes{direction=\"received\"} %g\n", received)
+	})
+}
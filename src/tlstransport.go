@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var errTLSPin = errors.New("tls: certificate doesn't match the pin")
+
+// tlsTransport wrap the stream in tls, so it looks like https on networks
+// which only let tls through
+type tlsTransport struct {
+	serverName string
+	pin        []byte
+}
+
+// NewTLSTransport return a transport sending serverName as SNI, the server
+// host if empty. With a pin, the hex sha256 of the server certificate, the
+// certificate is checked against it instead of the system roots, which
+// allows self-signed certificates.
+func NewTLSTransport(serverName, pin string) (Transport, error) {
+	t, err := newTLSTransport(serverName, pin)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func newTLSTransport(serverName, pin string) (*tlsTransport, error) {
+	t := &tlsTransport{serverName: serverName}
+	if pin != "" {
+		sum, err := hex.DecodeString(pin)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("tls: invalid certificate pin %q", pin)
+		}
+		t.pin = sum
+	}
+	return t, nil
+}
+
+func (t *tlsTransport) Dial(server string) (net.Conn, error) {
+	return dialTLS(server, t.config(server))
+}
+
+// config return the tls config to connect to server
+func (t *tlsTransport) config(server string) *tls.Config {
+	config := &tls.Config{ServerName: t.serverName}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(server)
+	}
+	if t.pin != nil {
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(certs [][]byte, _ [][]*x509.Certificate) error {
+			if len(certs) == 0 {
+				return errTLSPin
+			}
+			sum := sha256.Sum256(certs[0])
+			if !bytes.Equal(sum[:], t.pin) {
+				return errTLSPin
+			}
+			return nil
+		}
+	}
+	return config
+}
+
+// dialTLS connect to server and complete the tls handshake
+func dialTLS(server string, config *tls.Config) (net.Conn, error) {
+	conn, err := net.Dial("tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
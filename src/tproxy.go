@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// udpSessionTimeout is how long a udp session lives without replies
+const udpSessionTimeout = time.Minute
+
+// ServeTProxy to serve a listener from ListenTProxy. Intercepted connections
+// keep their original destination as local address, they are tunneled there.
+func (s *Service) ServeTProxy(listener *net.TCPListener) error {
+	return s.serve(s.handleTProxyConnection, []*net.TCPListener{listener})
+}
+
+func (s *Service) handleTProxyConnection(conn net.Conn) {
+	defer s.waitGroup.Done()
+	defer conn.Close()
+
+	s.publish(ConnEvent{Type: ConnAccepted, Remote: conn.RemoteAddr().String()})
+	dst, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	s.tunnelTransparent(conn, dst)
+}
+
+// udpSession relay the datagrams of one client to the server
+type udpSession struct {
+	remote  net.PacketConn
+	server  net.Addr
+	counter *trafficCounter
+	// sockets sending replies from the address they came from, only used
+	// by tproxyReplies
+	replies map[string]*net.UDPConn
+}
+
+// ServeTProxyUDP to relay datagrams received on conn from ListenTProxyUDP to
+// their original destination, until the service stops. Each client gets its
+// own session with the server, which ends after a minute without replies.
+func (s *Service) ServeTProxyUDP(conn *net.UDPConn) error {
+	s.waitGroup.Add(1)
+	defer s.waitGroup.Done()
+	s.serveOnce.Do(s.waitGroup.Done)
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-s.ch:
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+	defer func() {
+		mu.Lock()
+		for _, session := range sessions {
+			session.remote.Close()
+		}
+		mu.Unlock()
+	}()
+
+	buf := make([]byte, udpBufSize)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, client, err := conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			select {
+			case <-s.ch:
+				return nil
+			default:
+			}
+			return err
+		}
+		dst, err := udpOrigDst(oob[:oobn])
+		if err != nil {
+			s.debug.Println("tproxy udp:", err)
+			continue
+		}
+		rawaddr, addr, ok := s.transparentAddr(dst.IP, dst.Port)
+		if !ok {
+			s.debug.Println("unknown fake address:", dst)
+			continue
+		}
+
+		key := client.String()
+		mu.Lock()
+		session := sessions[key]
+		mu.Unlock()
+		if session == nil {
+			if session, err = s.newUDPSession(client, addr); err != nil {
+				s.debug.Println("tproxy udp:", err)
+				continue
+			}
+			mu.Lock()
+			sessions[key] = session
+			mu.Unlock()
+			go func(client *net.UDPAddr) {
+				s.tproxyReplies(session, client)
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+			}(client)
+		}
+
+		packet := append(rawaddr, buf[:n]...)
+		if _, err := session.remote.WriteTo(packet, session.server); err != nil {
+			s.debug.Println("udp write:", err)
+			continue
+		}
+		s.report(directionOutput, n, session.counter)
+	}
+}
+
+func (s *Service) newUDPSession(client *net.UDPAddr, dst string) (*udpSession, error) {
+	serverCipher := s.pickServer(PickRequest{Client: client.String(), Destination: dst, UDP: true})
+	if serverCipher == nil {
+		return nil, errNoUDPServer
+	}
+	server, err := net.ResolveUDPAddr("udp", serverCipher.server)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &udpSession{
+		remote:  serverCipher.cipher.PacketConn(pc),
+		server:  server,
+		counter: &trafficCounter{parent: s.serverCounter(serverCipher.server)},
+		replies: make(map[string]*net.UDPConn),
+	}, nil
+}
+
+// tproxyReplies relay the replies of the server to client, each from the
+// address it came from, until the session times out or is closed
+func (s *Service) tproxyReplies(session *udpSession, client *net.UDPAddr) {
+	defer func() {
+		session.remote.Close()
+		for _, reply := range session.replies {
+			reply.Close()
+		}
+	}()
+	buf := make([]byte, udpBufSize)
+	for {
+		session.remote.SetReadDeadline(s.now().Add(udpSessionTimeout))
+		n, _, err := session.remote.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		addrLen := udpAddrLen(buf[:n])
+		if addrLen < 0 {
+			continue
+		}
+		from := udpAddrHost(buf, addrLen)
+		reply, ok := session.replies[from]
+		if !ok {
+			laddr, err := s.transparentReplyAddr(from)
+			if err != nil {
+				s.debug.Println("tproxy udp:", err)
+				continue
+			}
+			if reply, err = listenTransparentUDP(laddr); err != nil {
+				s.debug.Println("tproxy udp:", err)
+				continue
+			}
+			session.replies[from] = reply
+		}
+		if _, err := reply.WriteToUDP(buf[addrLen:n], client); err != nil {
+			s.debug.Println("udp write:", err)
+			continue
+		}
+		s.report(directionInput, n-addrLen, session.counter)
+	}
+}
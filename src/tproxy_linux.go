@@ -0,0 +1,103 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// socket options of TPROXY, missing from package syscall
+const (
+	ipTransparent       = 19 // IP_TRANSPARENT
+	ipRecvOrigDstAddr   = 20 // IP_RECVORIGDSTADDR
+	ipv6Transparent     = 75 // IPV6_TRANSPARENT
+	ipv6RecvOrigDstAddr = 74 // IPV6_RECVORIGDSTADDR
+)
+
+// transparentControl let a socket accept connections and datagrams to any
+// address and send from any address, which needs CAP_NET_ADMIN
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, ipTransparent, 1)
+		if sockErr == nil && network[len(network)-1] != '4' {
+			// ignored on IPv4 only sockets
+			syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		}
+		if sockErr == nil {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// ListenTProxy return a tcp listener for connections intercepted by an
+// iptables TPROXY rule, to serve with ServeTProxy
+func ListenTProxy(addr string) (*net.TCPListener, error) {
+	lc := net.ListenConfig{Control: transparentControl}
+	listener, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return listener.(*net.TCPListener), nil
+}
+
+// ListenTProxyUDP return a udp socket for datagrams intercepted by an
+// iptables TPROXY rule, to serve with ServeTProxyUDP
+func ListenTProxyUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		if err := transparentControl(network, address, c); err != nil {
+			return err
+		}
+		return c.Control(func(fd uintptr) {
+			syscall.SetsockoptInt(int(fd), syscall.SOL_IP, ipRecvOrigDstAddr, 1)
+			syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1)
+		})
+	}}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// udpOrigDst return the original destination of a datagram from the control
+// messages received with it
+func udpOrigDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == ipRecvOrigDstAddr &&
+			len(msg.Data) >= syscall.SizeofSockaddrInet4:
+			sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&msg.Data[0]))
+			return &net.UDPAddr{IP: net.IP(append([]byte{}, sa.Addr[:]...)), Port: ntohs(sa.Port)}, nil
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6RecvOrigDstAddr &&
+			len(msg.Data) >= syscall.SizeofSockaddrInet6:
+			sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(&msg.Data[0]))
+			return &net.UDPAddr{IP: net.IP(append([]byte{}, sa.Addr[:]...)), Port: ntohs(sa.Port)}, nil
+		}
+	}
+	return nil, errors.New("no original destination in control messages")
+}
+
+// listenTransparentUDP return a udp socket bound to the foreign address
+// laddr, to send replies which seem to come from the original destination
+func listenTransparentUDP(laddr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: transparentControl}
+	pc, err := lc.ListenPacket(context.Background(), "udp", laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
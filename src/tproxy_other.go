@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errNoTProxy = errors.New("TPROXY is only supported on Linux")
+
+// ListenTProxy fail where TPROXY is not supported
+func ListenTProxy(addr string) (*net.TCPListener, error) {
+	return nil, errNoTProxy
+}
+
+// ListenTProxyUDP fail where TPROXY is not supported
+func ListenTProxyUDP(addr string) (*net.UDPConn, error) {
+	return nil, errNoTProxy
+}
+
+func udpOrigDst(oob []byte) (*net.UDPAddr, error) {
+	return nil, errNoTProxy
+}
+
+func listenTransparentUDP(laddr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errNoTProxy
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// Transport carry the shadowsocks stream to a server in place of a plain tcp
+// connection, to look like other traffic or pass through proxies
+type Transport interface {
+	// Dial connect to server, the stream starts with the first write
+	Dial(server string) (net.Conn, error)
+}
+
+// SetTransport set the transport to reach the server, nil for plain tcp. It
+// must be set before the server is given to a Service.
+func (sc *ServerCipher) SetTransport(t Transport) {
+	sc.transport = t
+}
+
+// dial connect to the server through its transport or plugin, timeout only
+// applies to plain tcp
+func (sc *ServerCipher) dial(timeout time.Duration) (net.Conn, error) {
+	if sc.transport != nil {
+		return sc.transport.Dial(sc.server)
+	}
+	server, err := sc.dialAddr()
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout("tcp", server, timeout)
+}
+
+// builtinPlugin return the transport implementing the SIP003 plugin name
+// with opts, nil when the plugin must be run
+func builtinPlugin(name, opts string) Transport {
+	switch name {
+	case "obfs-local", "simple-obfs":
+		return obfsFromPluginOpts(opts)
+	case "v2ray-plugin":
+		return wsFromPluginOpts(opts)
+	}
+	return nil
+}
+
+// pluginOptions parse the "key=value;flag" options of a SIP003 plugin
+func pluginOptions(opts string) map[string]string {
+	options := make(map[string]string)
+	for len(opts) > 0 {
+		var opt string
+		opt, opts = splitPair(opts, ';')
+		if opt == "" {
+			continue
+		}
+		key, value := splitPair(opt, '=')
+		options[key] = value
+	}
+	return options
+}
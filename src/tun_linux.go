@@ -0,0 +1,163 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	tunNICID       = 1
+	tunMaxInFlight = 1024 // tcp handshakes in progress
+)
+
+// ServeTUN to relay the tcp and udp flows of the packets routed to the TUN
+// device name, until the service stops. A user space tcp/ip stack ends the
+// flows and they are tunneled like socks requests. The device must be up,
+// with routes sending traffic to it, except the traffic to the servers.
+func (s *Service) ServeTUN(name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	fd, err := tun.Open(name)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	ep, err := fdbased.New(&fdbased.Options{FDs: []int{fd}, MTU: uint32(iface.MTU)})
+	if err != nil {
+		return err
+	}
+
+	st := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	defer st.Wait()
+	defer st.Close()
+	if err := st.CreateNIC(tunNICID, ep); err != nil {
+		return errors.New(err.String())
+	}
+	// accept packets to any address and answer from it
+	st.SetPromiscuousMode(tunNICID, true)
+	st.SetSpoofing(tunNICID, true)
+	st.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: tunNICID},
+		{Destination: header.IPv6EmptySubnet, NIC: tunNICID},
+	})
+
+	tcpForwarder := tcp.NewForwarder(st, 0, tunMaxInFlight, func(r *tcp.ForwarderRequest) {
+		id := r.ID()
+		var wq waiter.Queue
+		ep, err := r.CreateEndpoint(&wq)
+		if err != nil {
+			r.Complete(true)
+			return
+		}
+		r.Complete(false)
+		dst := &net.TCPAddr{IP: net.IP(id.LocalAddress.AsSlice()), Port: int(id.LocalPort)}
+		s.waitGroup.Add(1)
+		go s.handleTUNConnection(gonet.NewTCPConn(&wq, ep), dst)
+	})
+	st.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+
+	udpForwarder := udp.NewForwarder(st, func(r *udp.ForwarderRequest) bool {
+		id := r.ID()
+		var wq waiter.Queue
+		ep, err := r.CreateEndpoint(&wq)
+		if err != nil {
+			return false
+		}
+		client := &net.UDPAddr{IP: net.IP(id.RemoteAddress.AsSlice()), Port: int(id.RemotePort)}
+		dst := &net.UDPAddr{IP: net.IP(id.LocalAddress.AsSlice()), Port: int(id.LocalPort)}
+		s.waitGroup.Add(1)
+		go s.handleTUNFlow(gonet.NewUDPConn(&wq, ep), client, dst)
+		return true
+	})
+	st.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	s.waitGroup.Add(1)
+	defer s.waitGroup.Done()
+	s.serveOnce.Do(s.waitGroup.Done)
+	s.debug.Println("serving TUN device", name)
+	<-s.ch
+	return nil
+}
+
+func (s *Service) handleTUNConnection(conn net.Conn, dst *net.TCPAddr) {
+	defer s.waitGroup.Done()
+	defer conn.Close()
+
+	s.publish(ConnEvent{Type: ConnAccepted, Remote: conn.RemoteAddr().String()})
+	s.tunnelTransparent(conn, dst)
+}
+
+// handleTUNFlow relay the datagrams between client and dst, conn sends
+// from dst to client. The flow ends after a minute without traffic.
+func (s *Service) handleTUNFlow(conn net.Conn, client, dst *net.UDPAddr) {
+	defer s.waitGroup.Done()
+	defer conn.Close()
+
+	rawaddr, addr, ok := s.transparentAddr(dst.IP, dst.Port)
+	if !ok {
+		s.debug.Println("unknown fake address:", dst)
+		return
+	}
+	session, err := s.newUDPSession(client, addr)
+	if err != nil {
+		s.debug.Println("tun udp:", err)
+		return
+	}
+	defer session.remote.Close()
+
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, udpBufSize)
+		for {
+			session.remote.SetReadDeadline(s.now().Add(udpSessionTimeout))
+			n, _, err := session.remote.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			addrLen := udpAddrLen(buf[:n])
+			if addrLen < 0 {
+				continue
+			}
+			if _, err := conn.Write(buf[addrLen:n]); err != nil {
+				return
+			}
+			s.report(directionInput, n-addrLen, session.counter)
+		}
+	}()
+
+	buf := make([]byte, udpBufSize)
+	for {
+		conn.SetReadDeadline(s.now().Add(udpSessionTimeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		packet := append(rawaddr[:len(rawaddr):len(rawaddr)], buf[:n]...)
+		if _, err := session.remote.WriteTo(packet, session.server); err != nil {
+			s.debug.Println("udp write:", err)
+			continue
+		}
+		s.report(directionOutput, n, session.counter)
+	}
+}
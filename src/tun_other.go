@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// ServeTUN fail where TUN devices are not supported
+func (s *Service) ServeTUN(name string) error {
+	return errors.New("TUN devices are only supported on Linux")
+}
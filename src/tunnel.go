@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// ServeTunnel to serve a listener whose connections are all tunneled to the
+// fixed target host:port, without socks negotiation, like ss-tunnel
+func (s *Service) ServeTunnel(listener *net.TCPListener, target string) error {
+	rawaddr, err := ss.RawAddr(target)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	return s.serve(func(conn net.Conn) {
+		defer s.waitGroup.Done()
+		defer conn.Close()
+
+		s.publish(ConnEvent{Type: ConnAccepted, Remote: conn.RemoteAddr().String()})
+		s.tunnelRequest(conn, rawaddr, target, func(rep byte) error {
+			return nil
+		})
+	}, []*net.TCPListener{listener})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+)
+
+// udpBufSize is large enough for any udp datagram
+const udpBufSize = 64 * 1024
+
+// udpAddrLen return the length of the socks address at the start of b,
+// or -1 if it is malformed
+func udpAddrLen(b []byte) int {
+	if len(b) < 1 {
+		return -1
+	}
+	n := -1
+	switch b[0] {
+	case typeIPv4:
+		n = 1 + net.IPv4len + 2
+	case typeIPv6:
+		n = 1 + net.IPv6len + 2
+	case typeDm:
+		if len(b) < 2 || b[1] == 0 {
+			return -1
+		}
+		n = 1 + 1 + int(b[1]) + 2
+	}
+	if n > len(b) {
+		return -1
+	}
+	return n
+}
+
+// udpAddrHost return the host:port of the socks address at the start of b,
+// whose length n was checked, e.g. by udpAddrLen
+func udpAddrHost(b []byte, n int) string {
+	var host string
+	switch b[0] {
+	case typeIPv4, typeIPv6:
+		host = net.IP(b[1 : n-2]).String()
+	case typeDm:
+		host = string(b[2 : n-2])
+	}
+	port := binary.BigEndian.Uint16(b[n-2 : n])
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// handleUDPAssociate serve the UDP ASSOCIATE command. Datagrams from the
+// client are relayed to the server as shadowsocks udp packets and replies
+// are sent back, until the client closes the tcp connection. Datagrams to
+// blocked destinations are dropped.
+func (s *Service) handleUDPAssociate(conn net.Conn, addr string) {
+	localAddr, _ := conn.LocalAddr().(*net.TCPAddr)
+	laddr := &net.UDPAddr{}
+	if localAddr != nil {
+		laddr.IP = localAddr.IP
+	}
+	local, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		s.debug.Println("udp associate:", err)
+		conn.Write(socksReply(repGeneralFailure, unspecifiedAddr(conn)))
+		return
+	}
+	defer local.Close()
+
+	remoteAddr := conn.RemoteAddr().String()
+	serverCipher := s.pickServer(PickRequest{Client: remoteAddr, Destination: addr, UDP: true})
+	if serverCipher == nil {
+		s.debug.Println("udp associate:", errNoUDPServer)
+		conn.Write(socksReply(repGeneralFailure, unspecifiedAddr(conn)))
+		return
+	}
+	serverAddr, err := net.ResolveUDPAddr("udp", serverCipher.server)
+	if err != nil {
+		s.debug.Println("udp associate:", err)
+		conn.Write(socksReply(repHostUnreachable, unspecifiedAddr(conn)))
+		return
+	}
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		s.debug.Println("udp associate:", err)
+		conn.Write(socksReply(repGeneralFailure, unspecifiedAddr(conn)))
+		return
+	}
+	remote := serverCipher.cipher.PacketConn(pc)
+	defer remote.Close()
+
+	if _, err := conn.Write(socksReply(repSucceeded, local.LocalAddr())); err != nil {
+		s.debug.Println("udp associate:", err)
+		return
+	}
+	s.debug.Printf("udp associate for %s on %s via %s\n", remoteAddr, local.LocalAddr(), serverCipher.server)
+	if s.accessLog {
+		s.logger.Printf("udp associate for %s via %s", remoteAddr, serverCipher.server)
+	}
+
+	start := s.now()
+	counter := &trafficCounter{parent: s.serverCounter(serverCipher.server)}
+	ip := net.ParseIP(clientIP(conn.RemoteAddr()))
+	clients := make(chan *net.UDPAddr, 1)
+	done := make(chan bool)
+	go func() {
+		// the association ends with the tcp connection or the service
+		select {
+		case <-s.ch:
+		case <-done:
+		}
+		local.Close()
+		remote.Close()
+	}()
+	go func() {
+		s.udpReplies(remote, local, clients, counter)
+		conn.Close()
+	}()
+	go func() {
+		s.udpRequests(local, remote, serverAddr, ip, clients, counter)
+		conn.Close()
+	}()
+
+	conn.SetReadDeadline(time.Time{})
+	io.Copy(ioutil.Discard, conn)
+	close(done)
+	s.debug.Println("closed udp associate for", remoteAddr)
+	s.summarize(addr, serverCipher.server, start, counter.stats())
+}
+
+// udpRequests relay datagrams from the client to the server, stripping the
+// socks udp header. The first datagram tells the address of the client,
+// which is sent to clients.
+func (s *Service) udpRequests(local *net.UDPConn, remote net.PacketConn, server net.Addr,
+	clientIP net.IP, clients chan<- *net.UDPAddr, counter *trafficCounter) {
+	buf := make([]byte, udpBufSize)
+	var client *net.UDPAddr
+	for {
+		n, from, err := local.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(clientIP) || client != nil && from.Port != client.Port {
+			continue
+		}
+		// RSV(2) FRAG(1) address data, fragments are not supported
+		if n < 3 || buf[2] != 0 {
+			continue
+		}
+		addrLen := udpAddrLen(buf[3:n])
+		if addrLen < 0 {
+			continue
+		}
+		if dst := udpAddrHost(buf[3:n], addrLen); s.route(dst) == RouteReject {
+			s.debug.Println("blocked", dst)
+			continue
+		}
+		if client == nil {
+			client = from
+			clients <- client
+		}
+		if _, err := remote.WriteTo(buf[3:n], server); err != nil {
+			s.debug.Println("udp write:", err)
+			continue
+		}
+		s.report(directionOutput, n-3-addrLen, counter)
+	}
+}
+
+// udpReplies relay datagrams from the server to the client, adding the
+// socks udp header
+func (s *Service) udpReplies(remote net.PacketConn, local *net.UDPConn,
+	clients <-chan *net.UDPAddr, counter *trafficCounter) {
+	buf := make([]byte, udpBufSize)
+	var client *net.UDPAddr
+	for {
+		n, _, err := remote.ReadFrom(buf[3:])
+		if err != nil {
+			return
+		}
+		if client == nil {
+			select {
+			case client = <-clients:
+			default:
+				// nothing was sent yet, the reply can't be ours
+				continue
+			}
+		}
+		addrLen := udpAddrLen(buf[3 : 3+n])
+		if addrLen < 0 {
+			continue
+		}
+		buf[0], buf[1], buf[2] = 0, 0, 0
+		if _, err := local.WriteToUDP(buf[:3+n], client); err != nil {
+			s.debug.Println("udp write:", err)
+			continue
+		}
+		s.report(directionInput, n-addrLen, counter)
+	}
+}
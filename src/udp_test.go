@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startUDPEcho serve a shadowsocks udp server with cipher which sends every
+// packet back as is, until the test ends, and return its address
+func startUDPEcho(t *testing.T, cipher Cipher) string {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	server := cipher.PacketConn(pc)
+	go func() {
+		buf := make([]byte, udpBufSize)
+		for {
+			n, from, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.WriteTo(buf[:n], from)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// udpAssociate open a udp association through the socks proxy at socksAddr
+// and return the tcp connection holding it and the relay address
+func udpAssociate(t *testing.T, socksAddr string) (net.Conn, *net.UDPAddr) {
+	conn, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	var method [2]byte
+	conn.Write([]byte{socksVer5, 1, methodNoAuth})
+	if _, err := io.ReadFull(conn, method[:]); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{socksVer5, socksCmdUDP, 0, typeIPv4, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 3+1+net.IPv4len+2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != repSucceeded {
+		t.Fatalf("udp associate: reply %d", reply[1])
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+	return conn, relay
+}
+
+// socksDatagram return payload for dst with the socks udp header
+func socksDatagram(dst *net.UDPAddr, payload string) []byte {
+	return append(append([]byte{0, 0, 0}, ipRawAddr(dst.IP, dst.Port)...), payload...)
+}
+
+func TestUDPAssociateDropsBlocked(t *testing.T) {
+	cipher, err := NewServerCipher("", "aes-256-gcm", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, socksAddr := startClient(t, startUDPEcho(t, cipher.cipher), "aes-256-gcm", "secret")
+	blocklist, _ := NewBlocklist("10.0.0.1")
+	s.SetBlocklist(blocklist)
+
+	conn, relay := udpAssociate(t, socksAddr)
+	defer conn.Close()
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	blocked := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 53}
+	allowed := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 53}
+	client.Write(socksDatagram(blocked, "blocked"))
+	client.Write(socksDatagram(allowed, "allowed"))
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[3+7 : n]); got != "allowed" {
+		t.Fatalf("relayed %q, want the blocked datagram dropped", got)
+	}
+}
+
+func TestBindRefusesBlocked(t *testing.T) {
+	s := NewService(&ServerCipher{server: "server.test:8388"})
+	blocklist, _ := NewBlocklist("10.0.0.1")
+	s.SetBlocklist(blocklist)
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.handleBind(conn, "10.0.0.1:80")
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	reply := make([]byte, 3+1+net.IPv4len+2)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != repNotAllowed {
+		t.Fatalf("bind to a blocked address: reply %d", reply[1])
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	cipher, err := NewServerCipher("", "aes-256-gcm", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, socksAddr := startClient(t, startUDPEcho(t, cipher.cipher), "aes-256-gcm", "secret")
+
+	conn, relay := udpAssociate(t, socksAddr)
+	defer conn.Close()
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	dst := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 53}
+	buf := make([]byte, 1500)
+	for _, payload := range []string{"first", "second"} {
+		datagram := socksDatagram(dst, payload)
+		if _, err := client.Write(datagram); err != nil {
+			t.Fatal(err)
+		}
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the reply comes from dst with the same socks header
+		if !bytes.Equal(buf[:n], datagram) {
+			t.Fatalf("reply %v, want %v", buf[:n], datagram)
+		}
+	}
+}
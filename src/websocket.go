@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// websocket opcodes, see RFC 6455
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var errWebSocketHandshake = errors.New("websocket: handshake refused")
+
+// wsTransport carry the stream in the binary messages of a websocket, so the
+// server can sit behind a CDN or a reverse proxy
+type wsTransport struct {
+	host   string
+	path   string
+	useTLS bool
+}
+
+// NewWebSocketTransport return a transport connecting to the websocket at
+// path on host, over tls if useTLS is set. The server host is used when host
+// is empty, the host may differ from the server to go through a CDN.
+func NewWebSocketTransport(host, path string, useTLS bool) Transport {
+	if path == "" {
+		path = "/"
+	}
+	return &wsTransport{host: host, path: path, useTLS: useTLS}
+}
+
+// wsFromPluginOpts return the transport of the v2ray-plugin options, like
+// "tls;host=example.com;path=/ws", or nil for the modes it doesn't handle
+func wsFromPluginOpts(opts string) Transport {
+	options := pluginOptions(opts)
+	if mode := options["mode"]; mode != "" && mode != "websocket" {
+		return nil
+	}
+	_, useTLS := options["tls"]
+	return NewWebSocketTransport(options["host"], options["path"], useTLS)
+}
+
+func (t *wsTransport) Dial(server string) (net.Conn, error) {
+	host := t.host
+	if host == "" {
+		host, _, _ = net.SplitHostPort(server)
+	}
+	var conn net.Conn
+	var err error
+	if t.useTLS {
+		conn, err = dialTLS(server, &tls.Config{ServerName: host})
+	} else {
+		conn, err = net.Dial("tcp", server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ws, err := wsHandshake(conn, host, t.path)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// wsHandshake send the upgrade request and check the response
+func wsHandshake(conn net.Conn, host, path string) (*wsConn, error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	_, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\n"+
+		"Connection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		path, host, key)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	h := sha1.New()
+	h.Write([]byte(key + wsAcceptGUID))
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != accept {
+		return nil, errWebSocketHandshake
+	}
+	return &wsConn{Conn: conn, r: r}, nil
+}
+
+// wsConn send every write as a masked binary message and read the payload
+// of the data frames, answering pings
+type wsConn struct {
+	net.Conn
+	r       *bufio.Reader
+	writeMu sync.Mutex
+	remain  uint64
+	mask    []byte
+	maskPos int
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame write a single final frame, clients must mask their frames
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	var mask [4]byte
+	rand.Read(mask[:])
+	frame = append(frame, mask[:]...)
+	for i, c := range payload {
+		frame = append(frame, c^mask[i%4])
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.remain == 0 {
+		if err := c.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > c.remain {
+		b = b[:c.remain]
+	}
+	n, err := c.r.Read(b)
+	c.unmask(b[:n])
+	c.remain -= uint64(n)
+	return n, err
+}
+
+// readHeader read the header of the next data frame, control frames in
+// between are handled here
+func (c *wsConn) readHeader() error {
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return err
+	}
+	opcode := head[0] & 0x0f
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	c.mask, c.maskPos = nil, 0
+	if head[1]&0x80 != 0 {
+		c.mask = make([]byte, 4)
+		if _, err := io.ReadFull(c.r, c.mask); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case wsContinuation, wsText, wsBinary:
+		c.remain = length
+		return nil
+	case wsClose:
+		c.writeFrame(wsClose, nil)
+		return io.EOF
+	}
+	// control frames carry at most 125 bytes
+	if length > 125 {
+		return fmt.Errorf("websocket: control frame of %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+	c.unmask(payload)
+	if opcode == wsPing {
+		return c.writeFrame(wsPong, payload)
+	}
+	return nil
+}
+
+// unmask the payload of a masked frame, servers shouldn't mask but may
+func (c *wsConn) unmask(b []byte) {
+	if c.mask == nil {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos%4]
+		c.maskPos++
+	}
+}